@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/providers"
+)
+
+func registerAPIRoutes(r *mux.Router) {
+	r.HandleFunc("/providers", listProviders).Methods("GET").Name("ListProviders")
+	r.HandleFunc("/endpoints", listEndpoints).Methods("GET").Name("ListEndpoints")
+	r.HandleFunc("/endpoints/{name}/resync", requireToken(resyncEndpoint)).Methods("POST").Name("ResyncEndpoint")
+	r.HandleFunc("/resync", requireToken(resync)).Methods("POST").Name("Resync")
+	r.HandleFunc("/blocked", listBlocked).Methods("GET").Name("ListBlocked")
+	r.HandleFunc("/blocked/approve", requireToken(approveBlocked)).Methods("POST").Name("ApproveBlocked")
+	r.HandleFunc("/conflicts", listConflicts).Methods("GET").Name("ListConflicts")
+}
+
+// apiToken is the shared secret that requests changing the state of the
+// service must present. They are refused if it is empty, as the API is
+// served on the healthcheck port.
+var apiToken string
+
+// requireToken only passes on requests presenting the API token
+// as a bearer token.
+func requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if apiToken == "" {
+			http.Error(w, "This request is disabled, set EXTERNAL_LB_API_TOKEN to enable it", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			http.Error(w, "Invalid or missing API token", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// providerInfo describes a configured provider.
+type providerInfo struct {
+	Name         string                 `json:"name"`
+	Slug         string                 `json:"slug"`
+	Default      bool                   `json:"default"`
+	Concurrency  int                    `json:"concurrency"`
+	Capabilities providers.Capabilities `json:"capabilities"`
+}
+
+// listProviders returns the configured providers and their capabilities.
+func listProviders(w http.ResponseWriter, req *http.Request) {
+	list := make([]providerInfo, 0, len(lbProviders))
+	for i, p := range lbProviders {
+		list = append(list, providerInfo{
+			Name:         p.GetName(),
+			Slug:         p.slug,
+			Default:      i == 0,
+			Concurrency:  p.concurrency,
+			Capabilities: p.caps,
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// listEndpoints returns the desired and actual state of all endpoints.
+func listEndpoints(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, endpointStatus.List())
+}
+
+// resyncEndpoint re-applies the config of a single endpoint,
+// even if it is backing off after a failure.
+func resyncEndpoint(w http.ResponseWriter, req *http.Request) {
+	if !isLeader() {
+		http.Error(w, "This replica is not the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := mux.Vars(req)["name"]
+	if !endpointStatus.Known(name) {
+		http.Error(w, "No such endpoint: "+name, http.StatusNotFound)
+		return
+	}
+
+	logrus.Infof("Resync of endpoint %s requested through the API", name)
+	endpointStatus.Force(name)
+	retries.Succeeded(name)
+	scheduler.Trigger("api", true)
+	writeJSON(w, http.StatusAccepted, map[string]string{"endpoint": name, "status": "scheduled"})
+}
+
+// resync triggers a full reconcile.
+func resync(w http.ResponseWriter, req *http.Request) {
+	if !isLeader() {
+		http.Error(w, "This replica is not the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	logrus.Info("Resync requested through the API")
+	scheduler.Trigger("api", true)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "scheduled"})
+}
+
+// listBlocked returns the changes blocked by the removal guard.
+func listBlocked(w http.ResponseWriter, req *http.Request) {
+	blocked := guard.Blocked()
+	if blocked == nil {
+		blocked = []string{}
+	}
+	writeJSON(w, http.StatusOK, blocked)
+}
+
+// approveBlocked lets the next update exceed the removal limits. Updates
+// emptying the pool of a service whose scale is not 0 remain blocked.
+func approveBlocked(w http.ResponseWriter, req *http.Request) {
+	if !isLeader() {
+		http.Error(w, "This replica is not the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	logrus.Warn("Removal of endpoints and targets above the limits approved through the API")
+	guard.Approve()
+	scheduler.Trigger("api", true)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "scheduled"})
+}
+
+// listConflicts returns the services that cannot use their endpoint
+// because another service uses it.
+func listConflicts(w http.ResponseWriter, req *http.Request) {
+	conflicts := []metadata.Conflict{}
+	if m != nil {
+		conflicts = m.Conflicts()
+	}
+	writeJSON(w, http.StatusOK, conflicts)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("Failed to write API response: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestAPI(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(testConfig("vs-old", poolName("old", "app"), "7070", "10.0.0.9"))
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+		testService("api", "app", "vs-api", "9090", "10.0.0.2"),
+	}}
+	setTestGlobals(mem, fake)
+	scheduler = NewScheduler(time.Second, time.Second)
+	mem.SetError("vs-api", errors.New("virtual server not found"))
+
+	r := mux.NewRouter()
+	registerAPIRoutes(r)
+	apiToken = "secret"
+	defer func() { apiToken = "" }()
+	post := func(path, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	reconcileOnce := func() {
+		mem.Reset()
+		metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		UpdateProviderLBConfigs(metadataConfigs)
+	}
+	reconcileOnce()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/endpoints", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /endpoints: %d", rec.Code)
+	}
+	var list []EndpointStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("got %d endpoints, want 3: %s", len(list), rec.Body.String())
+	}
+
+	api, old, web := list[0], list[1], list[2]
+	if api.Endpoint != "vs-api" || api.Desired == nil || api.Actual != nil ||
+		api.LastOp != "ADD" || api.LastError != "virtual server not found" {
+		t.Errorf("unexpected status for vs-api: %+v", api)
+	}
+	if old.Endpoint != "vs-old" || old.Desired != nil || old.Actual == nil || old.LastOp != "REMOVE" {
+		t.Errorf("unexpected status for vs-old: %+v", old)
+	}
+	if web.Endpoint != "vs-web" || web.Desired == nil || web.LastOp != "ADD" || web.LastError != "" ||
+		len(web.Desired.LBTargets) != 1 || web.Desired.LBTargets[0].HostIP != "10.0.0.1" {
+		t.Errorf("unexpected status for vs-web: %+v", web)
+	}
+
+	// forcing an endpoint re-applies it even though it did not change
+	reconcileOnce()
+	rec = post("/endpoints/vs-web/resync", "secret")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /endpoints/vs-web/resync: %d", rec.Code)
+	}
+	reconcileOnce()
+	if got, want := callStrings(mem.Calls()), []string{"UPDATE vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls after endpoint resync = %v, want %v", got, want)
+	}
+
+	// forcing a failed endpoint skips its backoff
+	rec = post("/endpoints/vs-api/resync", "secret")
+	reconcileOnce()
+	if got, want := callStrings(mem.Calls()), []string{"ADD vs-api"}; !equalStrings(got, want) {
+		t.Errorf("calls after endpoint resync = %v, want %v", got, want)
+	}
+
+	rec = post("/endpoints/vs-unknown/resync", "secret")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST /endpoints/vs-unknown/resync: %d, want 404", rec.Code)
+	}
+
+	rec = post("/resync", "secret")
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("POST /resync: %d", rec.Code)
+	}
+	select {
+	case <-scheduler.notify:
+	default:
+		t.Error("POST /resync did not trigger a reconcile")
+	}
+
+	// changes require the token, and are disabled without one
+	if rec = post("/resync", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST /resync without token: %d, want 401", rec.Code)
+	}
+	if rec = post("/endpoints/vs-web/resync", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST /endpoints/vs-web/resync with wrong token: %d, want 401", rec.Code)
+	}
+	if rec = post("/blocked/approve", ""); rec.Code != http.StatusUnauthorized || guard.isApproved() {
+		t.Errorf("POST /blocked/approve without token: %d, approved %v", rec.Code, guard.isApproved())
+	}
+	apiToken = ""
+	if rec = post("/resync", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("POST /resync with the API token unset: %d, want 403", rec.Code)
+	}
+	select {
+	case <-scheduler.notify:
+		t.Error("POST /resync without token triggered a reconcile")
+	default:
+	}
+}
@@ -61,6 +61,38 @@ func (c *CattleClient) UpdateServiceFqdn(serviceName, stackName, fqdn string) er
 	return err
 }
 
+// SetServiceNote adds the note to the description of the service, replacing
+// the note added earlier, if any. An empty note removes the earlier note.
+func (c *CattleClient) SetServiceNote(serviceName, stackName, note string) error {
+	stacks, err := c.rancherClient.Environment.List(&client.ListOpts{
+		Filters: map[string]interface{}{"name": stackName, "removed_null": "1"},
+	})
+	if err != nil {
+		return err
+	}
+	if len(stacks.Data) == 0 {
+		return fmt.Errorf("Stack %s not found", stackName)
+	}
+
+	services, err := c.rancherClient.Service.List(&client.ListOpts{
+		Filters: map[string]interface{}{"name": serviceName, "environmentId": stacks.Data[0].Id, "removed_null": "1"},
+	})
+	if err != nil {
+		return err
+	}
+	if len(services.Data) == 0 {
+		return fmt.Errorf("Service %s/%s not found", stackName, serviceName)
+	}
+
+	service := &services.Data[0]
+	description := withServiceNote(service.Description, note)
+	if description == service.Description {
+		return nil
+	}
+	_, err = c.rancherClient.Service.Update(service, map[string]interface{}{"description": description})
+	return err
+}
+
 func (c *CattleClient) TestConnect() error {
 	opts := &client.ListOpts{}
 	_, err := c.rancherClient.ExternalDnsEvent.List(opts)
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+)
+
+// serviceNotePrefix starts the line external-lb adds to the description
+// of a service that cannot use its endpoint.
+const serviceNotePrefix = "[external-lb] "
+
+// withServiceNote returns the description with the line of the note
+// replaced by the note, or removed if the note is empty.
+func withServiceNote(description, note string) string {
+	var lines []string
+	for _, line := range strings.Split(description, "\n") {
+		if !strings.HasPrefix(line, serviceNotePrefix) {
+			lines = append(lines, line)
+		}
+	}
+	if note != "" {
+		lines = append(lines, serviceNotePrefix+note)
+	}
+	return strings.TrimLeft(strings.Join(lines, "\n"), "\n")
+}
+
+// conflictReporter reports the services that cannot use their endpoint
+// in their description in Cattle. Only services whose conflicts changed
+// since the last report are updated.
+type conflictReporter struct {
+	// setNote sets the note of the service, see CattleClient.SetServiceNote
+	setNote func(service model.ServiceRef, note string) error
+
+	mu       sync.Mutex
+	reported map[model.ServiceRef]string
+}
+
+func newConflictReporter(setNote func(service model.ServiceRef, note string) error) *conflictReporter {
+	return &conflictReporter{
+		setNote:  setNote,
+		reported: make(map[model.ServiceRef]string),
+	}
+}
+
+// Report updates the notes of the services in conflicts, and removes the
+// notes of the services reported earlier that are no longer in conflict.
+// Services that could not be updated are retried by the next report.
+func (r *conflictReporter) Report(conflicts []metadata.Conflict) {
+	notes := make(map[model.ServiceRef]string)
+	for _, conflict := range conflicts {
+		note := fmt.Sprintf("Endpoint %s is not applied, it is used by service %s: %s",
+			conflict.Endpoint, conflict.Winner, conflict.Reason)
+		if notes[conflict.Service] != "" {
+			note = notes[conflict.Service] + "; " + note
+		}
+		notes[conflict.Service] = note
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for service := range r.reported {
+		if _, ok := notes[service]; !ok {
+			notes[service] = ""
+		}
+	}
+	for service, note := range notes {
+		if r.reported[service] == note {
+			continue
+		}
+		if err := r.setNote(service, note); err != nil {
+			logrus.Errorf("Failed to report endpoint conflict of service %s: %v", service, err)
+			continue
+		}
+		if note == "" {
+			delete(r.reported, service)
+		} else {
+			r.reported[service] = note
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestEndpointConflicts(t *testing.T) {
+	const priorityLabel = "io.rancher.service.external_lb.priority"
+	newer := testService("newer", "app", "vs-web", "8080", "10.0.0.1")
+	newer.CreateIndex = 2
+	older := testService("older", "app", "vs-web", "8080", "10.0.0.2")
+	older.CreateIndex = 1
+	fake := &fakeMetadata{services: []rmetadata.Service{newer, older}}
+	setTestGlobals(memory.NewMemoryProvider(), fake)
+
+	var notes []string
+	reporter := newConflictReporter(func(service model.ServiceRef, note string) error {
+		notes = append(notes, service.String()+": "+note)
+		return nil
+	})
+	resolve := func() model.LBConfig {
+		metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reporter.Report(m.Conflicts())
+		return metadataConfigs["vs-web"]
+	}
+
+	// the oldest service wins regardless of the order of the services
+	for i := 0; i < 2; i++ {
+		if got := resolve(); got.LBTargetPoolName != poolName("older", "app") {
+			t.Errorf("poll %d: endpoint used by %s, want the older service", i, got.LBTargetPoolName)
+		}
+		fake.services[0], fake.services[1] = fake.services[1], fake.services[0]
+	}
+	want := []metadata.Conflict{{
+		Endpoint: "vs-web",
+		Service:  model.ServiceRef{Stack: "app", Name: "newer"},
+		Winner:   model.ServiceRef{Stack: "app", Name: "older"},
+		Reason:   "endpoint already used by a service with precedence",
+	}}
+	if got := m.Conflicts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("conflicts = %+v, want %+v", got, want)
+	}
+	if len(notes) != 1 {
+		t.Errorf("notes = %q, want a single note for app/newer", notes)
+	}
+
+	r := mux.NewRouter()
+	registerAPIRoutes(r)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/conflicts", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /conflicts: %d", rec.Code)
+	}
+	var listed []metadata.Conflict
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || !reflect.DeepEqual(listed, want) {
+		t.Errorf("GET /conflicts = %s, %v", rec.Body.String(), err)
+	}
+
+	// a priority label takes precedence over age
+	fake.services[0].Labels[priorityLabel] = "10"
+	fake.services[1].Labels[priorityLabel] = "10"
+	for i := range fake.services {
+		if fake.services[i].Name == "newer" {
+			fake.services[i].Labels[priorityLabel] = "20"
+		}
+	}
+	notes = nil
+	if got := resolve(); got.LBTargetPoolName != poolName("newer", "app") {
+		t.Errorf("endpoint used by %s, want the service with the higher priority", got.LBTargetPoolName)
+	}
+	wantNotes := []string{
+		"app/newer: ",
+		"app/older: Endpoint vs-web is not applied, it is used by service app/newer: endpoint already used by a service with precedence",
+	}
+	sort.Strings(notes)
+	if !equalStrings(notes, wantNotes) {
+		t.Errorf("notes = %q, want %q", notes, wantNotes)
+	}
+}
+
+func TestWithServiceNote(t *testing.T) {
+	tests := []struct {
+		description, note, want string
+	}{
+		{"", "conflict", "[external-lb] conflict"},
+		{"My service", "conflict", "My service\n[external-lb] conflict"},
+		{"My service\n[external-lb] old", "new", "My service\n[external-lb] new"},
+		{"My service\n[external-lb] old", "", "My service"},
+		{"[external-lb] old", "", ""},
+	}
+	for _, test := range tests {
+		if got := withServiceNote(test.description, test.note); got != test.want {
+			t.Errorf("withServiceNote(%q, %q) = %q, want %q", test.description, test.note, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+)
+
+// drainTracker records when targets removed from metadata were disabled
+// on the provider, so that they are deleted only after a timeout.
+type drainTracker struct {
+	timeout time.Duration
+
+	// onExpired is called when the drain timeout of a target has passed.
+	onExpired func()
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+
+	mu sync.Mutex
+	// drain start keyed by endpoint and target
+	started map[string]map[string]time.Time
+}
+
+// newDrainTracker returns a tracker for the specified timeout.
+// A timeout of 0 disables draining.
+func newDrainTracker(timeout time.Duration) *drainTracker {
+	return &drainTracker{
+		timeout: timeout,
+		now:     time.Now,
+		started: make(map[string]map[string]time.Time),
+	}
+}
+
+// drainer returns the provider as a TargetDrainer if draining is enabled
+// and the provider can both drain and incrementally remove targets.
+func (d *drainTracker) drainer(p *lbProvider) (providers.TargetDrainer, bool) {
+	if d.timeout <= 0 {
+		return nil, false
+	}
+	if _, ok := p.Provider.(providers.TargetUpdater); !ok {
+		return nil, false
+	}
+	drainer, ok := p.Provider.(providers.TargetDrainer)
+	return drainer, ok
+}
+
+func targetKey(target model.LBTarget) string {
+	return target.HostPort()
+}
+
+// Start records that the targets of the endpoint started draining now.
+func (d *drainTracker) Start(endpoint string, targets []model.LBTarget) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, target := range targets {
+		d.start(endpoint, target)
+	}
+}
+
+func (d *drainTracker) start(endpoint string, target model.LBTarget) {
+	if d.started[endpoint] == nil {
+		d.started[endpoint] = make(map[string]time.Time)
+	}
+	d.started[endpoint][targetKey(target)] = d.now()
+	if d.onExpired != nil {
+		time.AfterFunc(d.timeout, d.onExpired)
+	}
+}
+
+// Track starts the drain timeout of the disabled targets of the endpoint
+// that are not known to the tracker yet, e.g. after a restart.
+func (d *drainTracker) Track(endpoint string, targets []model.LBTarget) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, target := range targets {
+		if _, ok := d.started[endpoint][targetKey(target)]; !ok {
+			d.start(endpoint, target)
+		}
+	}
+}
+
+// Expired returns true if the drain timeout of the disabled target has
+// passed. Disabled targets not known to the tracker have not expired,
+// their timeout starts when Track is called for them.
+func (d *drainTracker) Expired(endpoint string, target model.LBTarget) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	started, ok := d.started[endpoint][targetKey(target)]
+	if !ok {
+		return false
+	}
+	return !d.now().Before(started.Add(d.timeout))
+}
+
+// Done stops tracking the targets of the endpoint, or all of
+// its targets if none are specified.
+func (d *drainTracker) Done(endpoint string, targets ...model.LBTarget) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(targets) == 0 {
+		delete(d.started, endpoint)
+		return
+	}
+	for _, target := range targets {
+		delete(d.started[endpoint], targetKey(target))
+	}
+	if len(d.started[endpoint]) == 0 {
+		delete(d.started, endpoint)
+	}
+}
+
+// Count returns the number of draining targets.
+func (d *drainTracker) Count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, targets := range d.started {
+		n += len(targets)
+	}
+	return n
+}
+
+// drainChanges splits the targets removed from an endpoint into those
+// to disable and those whose drain timeout has passed and that can be
+// deleted. It also returns whether any targets are still draining.
+func (d *drainTracker) drainChanges(endpoint string, removed []model.LBTarget) (disable, expired []model.LBTarget, waiting bool) {
+	for _, target := range removed {
+		switch {
+		case !target.Disabled:
+			disable = append(disable, target)
+		case d.Expired(endpoint, target):
+			expired = append(expired, target)
+		default:
+			waiting = true
+		}
+	}
+	return disable, expired, waiting
+}
+
+// trackDraining starts tracking the targets that are disabled on the
+// provider of the plan and no longer desired, so that targets found
+// draining after a restart are deleted once their timeout has passed.
+func (p *Plan) trackDraining() {
+	if _, ok := drains.drainer(p.provider); !ok {
+		return
+	}
+	for endpoint, desired := range p.desired {
+		current, ok := p.current[endpoint]
+		if !ok {
+			continue
+		}
+		_, removed := model.DiffLBTargets(desired.LBTargets, current.LBTargets)
+		var disabled []model.LBTarget
+		for _, target := range removed {
+			if target.Disabled {
+				disabled = append(disabled, target)
+			}
+		}
+		drains.Track(endpoint, disabled)
+	}
+}
+
+// resumedTargets returns the disabled targets that are desired again.
+func resumedTargets(desired, current []model.LBTarget) []model.LBTarget {
+	var resumed []model.LBTarget
+	for _, target := range current {
+		if target.Disabled && model.HasLBTarget(desired, target) {
+			resumed = append(resumed, target)
+		}
+	}
+	return resumed
+}
+
+// getDrainChangedConfigs returns the metadata configs that need an update
+// on a provider that drains removed targets: configs whose pool name or
+// owner changed or that have targets to add, reweight, resume, disable or
+// delete. Unlike
+// getChangedConfigs, it skips configs whose only difference are targets
+// that are still draining.
+func getDrainChangedConfigs(metadataConfigs, providerConfigs map[string]model.LBConfig) []model.LBConfig {
+	var toUpdate []model.LBConfig
+	for key, mLBConfig := range metadataConfigs {
+		pLBConfig, ok := providerConfigs[key]
+		if !ok {
+			continue
+		}
+		added, removed := model.DiffLBTargets(mLBConfig.LBTargets, pLBConfig.LBTargets)
+		disable, expired, _ := drains.drainChanges(key, removed)
+		if !strings.EqualFold(mLBConfig.LBTargetPoolName, pLBConfig.LBTargetPoolName) ||
+			len(added) > 0 || len(disable) > 0 || len(expired) > 0 ||
+			len(model.ReweightedLBTargets(mLBConfig.LBTargets, pLBConfig.LBTargets)) > 0 ||
+			len(resumedTargets(mLBConfig.LBTargets, pLBConfig.LBTargets)) > 0 ||
+			(pLBConfig.Protocol != "" && pLBConfig.Protocol != mLBConfig.Protocol) ||
+			(pLBConfig.Owner != nil && !model.SameOwner(pLBConfig.Owner, mLBConfig.Owner)) {
+			toUpdate = append(toUpdate, mLBConfig)
+		}
+	}
+
+	sortLBConfigs(toUpdate)
+	return toUpdate
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func setTestDrains(timeout time.Duration) *time.Time {
+	now := time.Unix(1000, 0)
+	drains = newDrainTracker(timeout)
+	drains.now = func() time.Time { return now }
+	return &now
+}
+
+func TestDrainTargets(t *testing.T) {
+	pool := poolName("web", "app")
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(testConfig("vs-web", pool, "8080", "10.0.0.1", "10.0.0.2"))
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+	}}
+	setTestGlobals(mem, fake)
+	now := setTestDrains(time.Minute)
+
+	reconcile := func() []string {
+		mem.Reset()
+		metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+			t.Fatal(err)
+		}
+		return callStrings(mem.Calls())
+	}
+
+	if got, want := reconcile(), []string{"DISABLE_TARGETS vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	draining := testConfig("vs-web", pool, "8080", "10.0.0.1", "10.0.0.2")
+	draining.LBTargets[1].Disabled = true
+	assertProviderState(t, "draining", mem, map[string]model.LBConfig{"vs-web": draining}, nil)
+	if n := drains.Count(); n != 1 {
+		t.Errorf("draining targets = %d, want 1", n)
+	}
+
+	*now = now.Add(30 * time.Second)
+	if got := reconcile(); len(got) != 0 {
+		t.Errorf("calls before the drain timeout = %v, want none", got)
+	}
+
+	*now = now.Add(30 * time.Second)
+	if got, want := reconcile(), []string{"REMOVE_TARGETS vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls after the drain timeout = %v, want %v", got, want)
+	}
+	assertProviderState(t, "drained", mem, map[string]model.LBConfig{
+		"vs-web": testConfig("vs-web", pool, "8080", "10.0.0.1"),
+	}, nil)
+	if n := drains.Count(); n != 0 {
+		t.Errorf("draining targets = %d, want 0", n)
+	}
+}
+
+func TestDrainTargetsResumed(t *testing.T) {
+	pool := poolName("web", "app")
+	draining := testConfig("vs-web", pool, "8080", "10.0.0.1", "10.0.0.2")
+	draining.LBTargets[1].Disabled = true
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(draining)
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+	}}
+	setTestGlobals(mem, fake)
+	now := setTestDrains(time.Minute)
+
+	// a target found disabled after a restart drains for a full timeout
+	metadataConfigs, _ := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+	if calls := mem.Calls(); len(calls) != 0 {
+		t.Errorf("calls = %v, want none", calls)
+	}
+	if n := drains.Count(); n != 1 {
+		t.Errorf("draining targets = %d, want 1", n)
+	}
+
+	// the target comes back before the timeout
+	*now = now.Add(30 * time.Second)
+	fake.services = []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.2"),
+	}
+	metadataConfigs, _ = m.GetMetadataLBConfigs(targetPoolSuffix)
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := callStrings(mem.Calls()), []string{"ENABLE_TARGETS vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	assertProviderState(t, "resumed", mem, map[string]model.LBConfig{
+		"vs-web": testConfig("vs-web", pool, "8080", "10.0.0.1", "10.0.0.2"),
+	}, nil)
+	if n := drains.Count(); n != 0 {
+		t.Errorf("draining targets = %d, want 0", n)
+	}
+}
+
+func TestDrainProtocolChanged(t *testing.T) {
+	pool := poolName("web", "app")
+	udp := testConfig("vs-web", pool, "8080", "10.0.0.1")
+	udp.Protocol = model.ProtocolUDP
+	udp.LBTargets[0].Protocol = model.ProtocolUDP
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(udp)
+	setTestGlobals(mem, &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+	}})
+	setTestDrains(time.Minute)
+
+	metadataConfigs, _ := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := callStrings(mem.Calls()), []string{"UPDATE vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	assertProviderState(t, "updated", mem, map[string]model.LBConfig{
+		"vs-web": testConfig("vs-web", pool, "8080", "10.0.0.1"),
+	}, nil)
+}
+
+func TestDrainPlanDoesNotTrack(t *testing.T) {
+	draining := testConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1", "10.0.0.2")
+	draining.LBTargets[1].Disabled = true
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(draining)
+	setTestGlobals(mem, &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+	}})
+	setTestDrains(time.Minute)
+
+	metadataConfigs, _ := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if _, err := PlanProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+	if n := drains.Count(); n != 0 {
+		t.Errorf("draining targets after planning = %d, want 0", n)
+	}
+
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+	if n := drains.Count(); n != 1 {
+		t.Errorf("draining targets after applying = %d, want 1", n)
+	}
+	if calls := mem.Calls(); len(calls) != 0 {
+		t.Errorf("calls = %v, want none", calls)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/leader"
+)
+
+// elector is nil unless leader election is enabled,
+// in which case every replica considers itself the leader.
+var elector *leader.Elector
+
+// errNotLeader is returned when this replica lost the leadership while
+// changing the provider. The remaining changes are left to the new leader.
+var errNotLeader = errors.New("This replica is no longer the leader")
+
+// isLeader returns true if this replica may change the provider.
+func isLeader() bool {
+	return elector == nil || elector.IsLeader()
+}
+
+// checkLeader returns errNotLeader if this replica may no longer change
+// the provider. It is called before every change, as the lease may expire
+// during a long update.
+func checkLeader() error {
+	if !isLeader() {
+		return errNotLeader
+	}
+	return nil
+}
+
+// newLeaderLock returns the lock of the leader election backend.
+func newLeaderLock(backend string) (leader.Lock, error) {
+	switch backend {
+	case "file":
+		return leader.NewFileLock(*leaderLock), nil
+	default:
+		return nil, fmt.Errorf("Unknown leader election backend '%s'", backend)
+	}
+}
+
+// replicaID returns an identity that is unique among the replicas.
+func replicaID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// onLeaderChange forces a full update when this replica becomes the
+// leader, since the provider may have been changed by the previous one.
+func onLeaderChange(leading bool) {
+	if leading {
+		scheduler.Trigger("leader", true)
+	}
+}
+
+// releaseOnSignal releases the lease on SIGTERM or SIGINT, so that a
+// standby can take over without waiting for the lease to expire.
+func releaseOnSignal(e *leader.Elector) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	logrus.Infof("Received %v, releasing leader lease", sig)
+	e.Stop()
+	os.Exit(0)
+}
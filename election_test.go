@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/external-lb/leader"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// grantedLock always grants the lease.
+type grantedLock struct{}
+
+func (grantedLock) TryAcquire(id string, ttl time.Duration) (bool, error) { return true, nil }
+func (grantedLock) Release(id string) error                               { return nil }
+
+// steppingDownProvider loses the leadership during its first add.
+type steppingDownProvider struct {
+	*memory.MemoryProvider
+}
+
+func (p steppingDownProvider) AddLBConfig(config model.LBConfig) (string, error) {
+	fqdn, err := p.MemoryProvider.AddLBConfig(config)
+	if elector.IsLeader() {
+		elector.Stop()
+	}
+	return fqdn, err
+}
+
+func TestLeadershipLostDuringUpdate(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	setTestGlobals(mem, &fakeMetadata{services: []rmetadata.Service{
+		testService("api", "app", "vs-api", "9090", "10.0.0.2"),
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+	}})
+	lbProviders = []*lbProvider{newLBProvider("memory", steppingDownProvider{mem})}
+	elector = leader.NewElector(grantedLock{}, "a", time.Minute, nil)
+	go elector.Run()
+	for !elector.IsLeader() {
+		time.Sleep(time.Millisecond)
+	}
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != errNotLeader {
+		t.Errorf("error = %v, want %v", err, errNotLeader)
+	}
+	if got, want := callStrings(mem.Calls()), []string{"ADD vs-api"}; !equalStrings(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	if n := retries.Len(); n != 0 {
+		t.Errorf("retries = %d, want none", n)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type Op int
@@ -15,43 +18,137 @@ const (
 	UPDATE
 )
 
+func (op Op) String() string {
+	switch op {
+	case ADD:
+		return "ADD"
+	case REMOVE:
+		return "REMOVE"
+	case UPDATE:
+		return "UPDATE"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// UpdateProviderLBConfigs applies the specified metadata configs to the
+// providers they are routed to. It returns the configs for which a provider
+// reported an FQDN, keyed by FQDN. An error is returned if the configs of a
+// provider could not be read, if the changes of a provider were blocked by
+// the removal guard, or if any endpoint is left out of sync.
 func UpdateProviderLBConfigs(metadataConfigs map[string]model.LBConfig) (map[string]model.LBConfig, error) {
-	providerConfigs, err := getProviderLBConfigs()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get LB configs from provider: %v", err)
+	plans, planErr := PlanProviderLBConfigs(metadataConfigs)
+	if len(plans) == 0 && planErr != nil {
+		return nil, planErr
 	}
 
-	removeExtraConfigs(metadataConfigs, providerConfigs)
-	updated := addMissingConfigs(metadataConfigs, providerConfigs)
-	updated_ := updateExistingConfigs(metadataConfigs, providerConfigs)
-	for k, v := range updated_ {
-		if _, ok := updated[k]; !ok {
+	forced := endpointStatus.TakeForced()
+	pending := make(map[string]bool)
+	var allowed []*Plan
+	for _, plan := range plans {
+		plan.Force(forced)
+		if err := guard.Check(plan); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		allowed = append(allowed, plan)
+		for endpoint := range plan.Endpoints() {
+			pending[endpoint] = true
+		}
+	}
+	guard.clearApproval()
+
+	// failures of endpoints without pending changes are no longer relevant,
+	// unless they belong to a provider whose configs could not be read
+	if planErr == nil {
+		retries.Prune(pending)
+	}
+
+	updated := make(map[string]model.LBConfig)
+	for _, plan := range allowed {
+		for k, v := range plan.Apply() {
 			updated[k] = v
 		}
 	}
+	if err := checkLeader(); err != nil {
+		// the new leader updates the provider and the service FQDNs
+		return nil, err
+	}
+
+	if planErr != nil {
+		return updated, planErr
+	}
+	if blocked := guard.Blocked(); len(blocked) > 0 {
+		return updated, fmt.Errorf("%d changes were blocked by the removal guard", len(blocked))
+	}
+	if n := retries.Len(); n > 0 {
+		return updated, fmt.Errorf("%d LB configs could not be applied", n)
+	}
 
 	return updated, nil
 }
 
-func getProviderLBConfigs() (map[string]model.LBConfig, error) {
-	allConfigs, err := provider.GetLBConfigs()
+// getProviderLBConfigs returns the configs of the provider
+// owned by this instance, keyed by endpoint.
+func getProviderLBConfigs(p *lbProvider) (map[string]model.LBConfig, error) {
+	allConfigs, err := p.GetLBConfigs()
 	if err != nil {
+		providerErrors.Inc(p.GetName(), "GET")
 		return nil, err
 	}
 
 	rancherConfigs := make(map[string]model.LBConfig, len(allConfigs))
-	suffix := "_" + m.EnvironmentUUID + "_" + targetPoolSuffix
 	for _, value := range allConfigs {
-		if strings.HasSuffix(value.LBTargetPoolName, suffix) {
+		if ownsLBConfig(value) {
 			rancherConfigs[value.LBEndpoint] = value
 		}
 	}
 
-	logrus.Debugf("LBConfigs from provider: %v", allConfigs)
+	logrus.Debugf("LBConfigs from provider %s: %v", p.slug, allConfigs)
 	return rancherConfigs, nil
 }
 
-func removeExtraConfigs(metadataConfigs, providerConfigs map[string]model.LBConfig) map[string]model.LBConfig {
+// ownsLBConfig returns true if the provider config belongs to this
+// instance: by its owner record, or by the suffix of its pool name
+// if it has none.
+func ownsLBConfig(config model.LBConfig) bool {
+	if config.Owner != nil {
+		return config.Owner.Owns(m.EnvironmentUUID, m.InstanceID)
+	}
+	return strings.HasSuffix(config.LBTargetPoolName, "_"+m.EnvironmentUUID+"_"+targetPoolSuffix)
+}
+
+// Apply makes the changes of the plan on its provider: removals first,
+// then additions and updates.
+func (p *Plan) Apply() map[string]model.LBConfig {
+	p.trackDraining()
+
+	logChanges(p.provider, "remove", p.Remove)
+	updateProvider(p.provider, p.Remove, REMOVE, p.current)
+
+	logChanges(p.provider, "add", p.Add)
+	updated := updateProvider(p.provider, p.Add, ADD, p.current)
+
+	logChanges(p.provider, "update", p.Update)
+	for k, v := range updateProvider(p.provider, p.Update, UPDATE, p.current) {
+		if _, ok := updated[k]; !ok {
+			updated[k] = v
+		}
+	}
+
+	return updated
+}
+
+func logChanges(p *lbProvider, verb string, configs []model.LBConfig) {
+	if len(configs) == 0 {
+		logrus.Debugf("No LB configs to %s on provider %s", verb, p.slug)
+	} else {
+		logrus.Infof("LB configs to %s on provider %s: %d", verb, p.slug, len(configs))
+	}
+}
+
+// getExtraConfigs returns the provider configs that have no
+// corresponding config in metadata.
+func getExtraConfigs(metadataConfigs, providerConfigs map[string]model.LBConfig) []model.LBConfig {
 	var toRemove []model.LBConfig
 	for key := range providerConfigs {
 		if _, ok := metadataConfigs[key]; !ok {
@@ -59,16 +156,13 @@ func removeExtraConfigs(metadataConfigs, providerConfigs map[string]model.LBConf
 		}
 	}
 
-	if len(toRemove) == 0 {
-		logrus.Debug("No LB configs to remove")
-	} else {
-		logrus.Infof("LB configs to remove: %d", len(toRemove))
-	}
-
-	return updateProvider(toRemove, REMOVE)
+	sortLBConfigs(toRemove)
+	return toRemove
 }
 
-func addMissingConfigs(metadataConfigs, providerConfigs map[string]model.LBConfig) map[string]model.LBConfig {
+// getMissingConfigs returns the metadata configs that do not
+// exist on the provider yet.
+func getMissingConfigs(metadataConfigs, providerConfigs map[string]model.LBConfig) []model.LBConfig {
 	var toAdd []model.LBConfig
 	for key := range metadataConfigs {
 		if _, ok := providerConfigs[key]; !ok {
@@ -76,16 +170,13 @@ func addMissingConfigs(metadataConfigs, providerConfigs map[string]model.LBConfi
 		}
 	}
 
-	if len(toAdd) == 0 {
-		logrus.Debug("No LB configs to add")
-	} else {
-		logrus.Infof("LB configs to add: %d", len(toAdd))
-	}
-
-	return updateProvider(toAdd, ADD)
+	sortLBConfigs(toAdd)
+	return toAdd
 }
 
-func updateExistingConfigs(metadataConfigs, providerConfigs map[string]model.LBConfig) map[string]model.LBConfig {
+// getChangedConfigs returns the metadata configs whose pool name, targets,
+// target weights, protocol or owner differ from the config on the provider.
+func getChangedConfigs(metadataConfigs, providerConfigs map[string]model.LBConfig) []model.LBConfig {
 	var toUpdate []model.LBConfig
 	for key := range metadataConfigs {
 		if _, ok := providerConfigs[key]; ok {
@@ -97,6 +188,8 @@ func updateExistingConfigs(metadataConfigs, providerConfigs map[string]model.LBC
 			if strings.EqualFold(mLBConfig.LBTargetPoolName, pLBConfig.LBTargetPoolName) {
 				if len(mLBConfig.LBTargets) != len(pLBConfig.LBTargets) {
 					update = true
+				} else if len(model.ReweightedLBTargets(mLBConfig.LBTargets, pLBConfig.LBTargets)) > 0 {
+					update = true
 				} else {
 					//check if any target have changed
 					for _, mTarget := range mLBConfig.LBTargets {
@@ -120,49 +213,218 @@ func updateExistingConfigs(metadataConfigs, providerConfigs map[string]model.LBC
 				update = true
 			}
 
+			if pLBConfig.Protocol != "" && pLBConfig.Protocol != mLBConfig.Protocol {
+				logrus.Debugf("The LBEndPoint %s will be updated to use protocol %s", key, mLBConfig.Protocol)
+				update = true
+			}
+
+			if pLBConfig.Owner != nil && !model.SameOwner(pLBConfig.Owner, mLBConfig.Owner) {
+				logrus.Debugf("The LBEndPoint %s will be updated to be owned by %s", key, mLBConfig.Owner)
+				update = true
+			}
+
 			if update {
 				toUpdate = append(toUpdate, metadataConfigs[key])
 			}
 		}
 	}
 
-	if len(toUpdate) == 0 {
-		logrus.Debug("No LB configs to update")
-	} else {
-		logrus.Infof("LB configs to update: %d", len(toUpdate))
-	}
-
-	return updateProvider(toUpdate, UPDATE)
+	sortLBConfigs(toUpdate)
+	return toUpdate
 }
 
-func updateProvider(toChange []model.LBConfig, op Op) map[string]model.LBConfig {
+func updateProvider(p *lbProvider, toChange []model.LBConfig, op Op, current map[string]model.LBConfig) map[string]model.LBConfig {
 	// map of FQDN -> LBConfig
 	updateFqdn := make(map[string]model.LBConfig)
-	for _, value := range toChange {
-		switch op {
-		case ADD:
-			logrus.Infof("Adding LB config: %v", value)
-			fqdn, err := provider.AddLBConfig(value)
-			if err != nil {
-				logrus.Errorf("Failed to add LB config for endpoint %s: %v", value.LBEndpoint, err)
-			} else if fqdn != "" {
-				updateFqdn[fqdn] = value
-			}
-		case REMOVE:
-			logrus.Infof("Removing LB config: %v", value)
-			if err := provider.RemoveLBConfig(value); err != nil {
-				logrus.Errorf("Failed to remove LB config for endpoint %s: %v", value.LBEndpoint, err)
-			}
-		case UPDATE:
+	var mu sync.Mutex
+	forEachEndpoint(toChange, p.concurrency, func(value model.LBConfig) {
+		if fqdn := applyLBConfig(p, value, op, current[value.LBEndpoint]); fqdn != "" {
+			mu.Lock()
+			updateFqdn[fqdn] = value
+			mu.Unlock()
+		}
+	})
+
+	return updateFqdn
+}
+
+// applyLBConfig applies a single operation to a provider unless the
+// endpoint is backing off after a failure. Current is the config of the
+// endpoint on the provider, if any. It returns the FQDN reported by the
+// provider, if any.
+func applyLBConfig(p *lbProvider, value model.LBConfig, op Op, current model.LBConfig) string {
+	if !isLeader() {
+		logrus.Debugf("Not the leader, skipping %s of LB config for endpoint %s", op, value.LBEndpoint)
+		return ""
+	}
+	if !retries.Ready(value.LBEndpoint) {
+		failures, _ := retries.Failures(value.LBEndpoint)
+		logrus.Infof("Skipping %s of LB config for endpoint %s: backing off after %d failed attempts",
+			op, value.LBEndpoint, failures)
+		return ""
+	}
+
+	var fqdn string
+	var err error
+	switch op {
+	case ADD:
+		logrus.Infof("Adding LB config: %v", value)
+		fqdn, err = p.AddLBConfig(value)
+	case REMOVE:
+		logrus.Infof("Removing LB config: %v", value)
+		err = p.RemoveLBConfig(value)
+	case UPDATE:
+		var handled bool
+		if handled, err = updateTargets(p, value, current); !handled {
 			logrus.Infof("Updating LB config: %v", value)
-			fqdn, err := provider.UpdateLBConfig(value)
-			if err != nil {
-				logrus.Errorf("Failed to update LB config for endpoint %s: %v", value.LBEndpoint, err)
-			} else if fqdn != "" {
-				updateFqdn[fqdn] = value
-			}
+			fqdn, err = p.UpdateLBConfig(value)
+		} else if err == nil {
+			err = updateOwner(p, value, current)
+			fqdn = current.FQDN
 		}
 	}
+	if err == errNotLeader {
+		// neither a failure of the endpoint nor to be retried
+		logrus.Warnf("Aborted %s of LB config for endpoint %s: %v", op, value.LBEndpoint, err)
+		return ""
+	}
 
-	return updateFqdn
+	providerOps.Inc(p.GetName(), op.String())
+	endpointStatus.SetResult(value.LBEndpoint, op, err)
+	if err != nil {
+		providerErrors.Inc(p.GetName(), op.String())
+		delay := retries.Failed(value.LBEndpoint, op, err)
+		logrus.Errorf("Failed to %s LB config for endpoint %s: %v. Retrying in %v",
+			strings.ToLower(op.String()), value.LBEndpoint, err, delay)
+		return ""
+	}
+
+	retries.Succeeded(value.LBEndpoint)
+	if op == REMOVE {
+		drains.Done(value.LBEndpoint)
+	}
+	return fqdn
+}
+
+// updateTargets adds and removes the targets that differ between the
+// desired and current config of an endpoint, if the provider implements
+// providers.TargetUpdater and only the targets changed. Changed weights
+// require the provider to implement providers.TargetWeighter as well. If draining is
+// enabled, removed targets are disabled first and only deleted once their
+// drain timeout has passed. It returns false if the whole config has to be
+// updated instead.
+func updateTargets(p *lbProvider, desired, current model.LBConfig) (bool, error) {
+	updater, ok := p.Provider.(providers.TargetUpdater)
+	if !ok || !strings.EqualFold(desired.LBTargetPoolName, current.LBTargetPoolName) {
+		return false, nil
+	}
+	if current.LBTargetPort != "" && current.LBTargetPort != desired.LBTargetPort {
+		return false, nil
+	}
+	if current.Protocol != "" && current.Protocol != desired.Protocol {
+		return false, nil
+	}
+
+	reweighted := model.ReweightedLBTargets(desired.LBTargets, current.LBTargets)
+	weighter, canWeight := p.Provider.(providers.TargetWeighter)
+	if len(reweighted) > 0 && !canWeight {
+		return false, nil
+	}
+
+	endpoint := desired.LBEndpoint
+	added, removed := model.DiffLBTargets(desired.LBTargets, current.LBTargets)
+	var resumed, disable []model.LBTarget
+	var waiting bool
+	drainer, draining := drains.drainer(p)
+	if draining {
+		resumed = resumedTargets(desired.LBTargets, current.LBTargets)
+		disable, removed, waiting = drains.drainChanges(endpoint, removed)
+	}
+	if len(added) == 0 && len(removed) == 0 && len(reweighted) == 0 &&
+		len(resumed) == 0 && len(disable) == 0 && !waiting {
+		// forced update of an endpoint that is in sync,
+		// unless only its owner record needs to be stored
+		return ownerChanged(p, desired, current), nil
+	}
+
+	logrus.Infof("Updating targets of LB config for endpoint %s: adding %v, removing %v",
+		endpoint, added, removed)
+	// add first, so that the pool does not run out of targets in between
+	if len(added) > 0 {
+		if err := checkLeader(); err != nil {
+			return true, err
+		}
+		if err := updater.AddTargets(endpoint, added); err != nil {
+			return true, err
+		}
+	}
+	if len(reweighted) > 0 {
+		logrus.Infof("Changing weights of targets %v of endpoint %s", reweighted, endpoint)
+		if err := checkLeader(); err != nil {
+			return true, err
+		}
+		if err := weighter.SetTargetWeights(endpoint, reweighted); err != nil {
+			return true, err
+		}
+	}
+	if len(resumed) > 0 {
+		logrus.Infof("Enabling draining targets %v of endpoint %s", resumed, endpoint)
+		if err := checkLeader(); err != nil {
+			return true, err
+		}
+		if err := drainer.EnableTargets(endpoint, resumed); err != nil {
+			return true, err
+		}
+		drains.Done(endpoint, resumed...)
+	}
+	if len(disable) > 0 {
+		logrus.Infof("Draining targets %v of endpoint %s for %v before removing them",
+			disable, endpoint, drains.timeout)
+		if err := checkLeader(); err != nil {
+			return true, err
+		}
+		if err := drainer.DisableTargets(endpoint, disable); err != nil {
+			return true, err
+		}
+		drains.Start(endpoint, disable)
+	}
+	if len(removed) > 0 {
+		if err := checkLeader(); err != nil {
+			return true, err
+		}
+		if err := updater.RemoveTargets(endpoint, removed); err != nil {
+			return true, err
+		}
+		drains.Done(endpoint, removed...)
+	}
+	return true, nil
+}
+
+// updateOwner stores the owner record of the desired config on the
+// provider if it implements providers.OwnerRecorder and the record
+// differs from the current one.
+func updateOwner(p *lbProvider, desired, current model.LBConfig) error {
+	if !ownerChanged(p, desired, current) {
+		return nil
+	}
+	logrus.Infof("Recording owner %s of endpoint %s", desired.Owner, desired.LBEndpoint)
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	return p.Provider.(providers.OwnerRecorder).SetOwner(desired.LBEndpoint, *desired.Owner)
+}
+
+// ownerChanged returns true if the provider records owners and the
+// owner record of the desired config differs from the current one.
+func ownerChanged(p *lbProvider, desired, current model.LBConfig) bool {
+	_, ok := p.Provider.(providers.OwnerRecorder)
+	return ok && desired.Owner != nil && !model.SameOwner(desired.Owner, current.Owner)
+}
+
+// sortLBConfigs orders the configs by endpoint so that provider
+// calls are made in a deterministic order.
+func sortLBConfigs(configs []model.LBConfig) {
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].LBEndpoint < configs[j].LBEndpoint
+	})
 }
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	testEnvUUID = "env1"
+	testSuffix  = "rancher.internal"
+
+	serviceLabelEndpoint = "io.rancher.service.external_lb.endpoint"
+	serviceLabelProvider = "io.rancher.service.external_lb.provider"
+)
+
+// fakeMetadata serves a fixed metadata snapshot. Methods not
+// overridden here panic through the nil embedded interface.
+type fakeMetadata struct {
+	rmetadata.Client
+	services []rmetadata.Service
+	hosts    []rmetadata.Host
+}
+
+func (f *fakeMetadata) GetServices() ([]rmetadata.Service, error) {
+	return f.services, nil
+}
+
+func (f *fakeMetadata) GetHosts() ([]rmetadata.Host, error) {
+	return f.hosts, nil
+}
+
+func (f *fakeMetadata) GetVersion() (string, error) {
+	return "1", nil
+}
+
+// testService returns a service exposing hostPort with one running
+// container per host IP.
+func testService(name, stack, endpoint, hostPort string, hostIPs ...string) rmetadata.Service {
+	svc := rmetadata.Service{
+		Name:      name,
+		StackName: stack,
+		Ports:     []string{hostPort + ":80/tcp"},
+		Labels:    map[string]string{serviceLabelEndpoint: endpoint},
+	}
+	for i, ip := range hostIPs {
+		svc.Containers = append(svc.Containers, rmetadata.Container{
+			Name:        fmt.Sprintf("%s-%s-%d", stack, name, i+1),
+			ServiceName: name,
+			StackName:   stack,
+			State:       "running",
+			Ports:       []string{ip + ":" + hostPort + ":80/tcp"},
+		})
+	}
+	return svc
+}
+
+func poolName(service, stack string) string {
+	return fmt.Sprintf("%s_%s_%s_%s", service, stack, testEnvUUID, testSuffix)
+}
+
+func testConfig(endpoint, pool, port string, hostIPs ...string) model.LBConfig {
+	config := model.LBConfig{
+		LBEndpoint:       endpoint,
+		LBTargetPoolName: pool,
+		LBTargetPort:     port,
+		Protocol:         model.ProtocolTCP,
+		Owner:            testOwner(""),
+	}
+	for _, ip := range hostIPs {
+		config.LBTargets = append(config.LBTargets, testTarget(ip, port))
+	}
+	return config
+}
+
+// legacyConfig returns a config as created before owner records.
+func legacyConfig(endpoint, pool, port string, hostIPs ...string) model.LBConfig {
+	config := testConfig(endpoint, pool, port, hostIPs...)
+	config.Owner = nil
+	return config
+}
+
+// testOwner returns the owner record of the configs of the
+// service with the UUID in the test environment.
+func testOwner(serviceUUID string) *model.Owner {
+	return &model.Owner{
+		Environment: testEnvUUID,
+		Service:     serviceUUID,
+		Instance:    testSuffix,
+		Version:     model.OwnerVersion,
+	}
+}
+
+// testTarget returns a TCP target as read from metadata.
+func testTarget(ip, port string) model.LBTarget {
+	target := model.NewLBTarget(net.ParseIP(ip), port)
+	target.Protocol = model.ProtocolTCP
+	return target
+}
+
+type reconcileStep struct {
+	name      string
+	services  []rmetadata.Service
+	wantCalls []string
+	wantFqdns []string
+}
+
+type reconcileTest struct {
+	name    string
+	initial []model.LBConfig
+	fqdn    string
+	// fullUpdates hides the provider's TargetUpdater implementation
+	fullUpdates bool
+	steps       []reconcileStep
+	untouched   []string
+}
+
+var reconcileTests = []reconcileTest{
+	{
+		name: "add, scale and remove",
+		steps: []reconcileStep{
+			{
+				name: "nothing labelled",
+				services: []rmetadata.Service{
+					{Name: "db", StackName: "app", Ports: []string{"5432:5432/tcp"}},
+				},
+			},
+			{
+				name: "two new services",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+					testService("api", "app", "vs-api", "9090", "10.0.0.2"),
+				},
+				wantCalls: []string{"ADD vs-api", "ADD vs-web"},
+			},
+			{
+				name: "scale up web",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.3"),
+					testService("api", "app", "vs-api", "9090", "10.0.0.2"),
+				},
+				wantCalls: []string{"ADD_TARGETS vs-web"},
+			},
+			{
+				name: "move web to another host",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.4"),
+					testService("api", "app", "vs-api", "9090", "10.0.0.2"),
+				},
+				wantCalls: []string{"ADD_TARGETS vs-web", "REMOVE_TARGETS vs-web"},
+			},
+			{
+				name: "remove api",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.4"),
+				},
+				wantCalls: []string{"REMOVE vs-api"},
+			},
+		},
+	},
+	{
+		name: "endpoint label changes",
+		steps: []reconcileStep{
+			{
+				name: "initial",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-b", "8080", "10.0.0.1"),
+				},
+				wantCalls: []string{"ADD vs-b"},
+			},
+			{
+				name: "relabel",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-a", "8080", "10.0.0.1"),
+				},
+				wantCalls: []string{"REMOVE vs-b", "ADD vs-a"},
+			},
+		},
+	},
+	{
+		name: "pool name and port changes",
+		initial: []model.LBConfig{
+			testConfig("vs-web", poolName("old", "app"), "8080", "10.0.0.1"),
+			testConfig("vs-api", poolName("api", "app"), "9090", "10.0.0.2"),
+		},
+		steps: []reconcileStep{
+			{
+				name: "pool renamed and port changed",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+					testService("api", "app", "vs-api", "9091", "10.0.0.2"),
+				},
+				wantCalls: []string{"UPDATE vs-api", "UPDATE vs-web"},
+			},
+		},
+	},
+	{
+		name: "configs owned by others are left alone",
+		initial: []model.LBConfig{
+			legacyConfig("vs-other-env", "web_app_env2_"+testSuffix, "8080", "10.0.0.1"),
+			legacyConfig("vs-other-suffix", "web_app_"+testEnvUUID+"_other", "8080", "10.0.0.1"),
+			legacyConfig("vs-manual", "manual-pool", "8080", "10.0.0.1"),
+			// another instance sharing the provider and the pool name suffix
+			func() model.LBConfig {
+				config := testConfig("vs-other-instance", poolName("web", "app"), "8080", "10.0.0.1")
+				config.Owner.Instance = "blue"
+				return config
+			}(),
+		},
+		steps: []reconcileStep{
+			{
+				name:     "empty metadata",
+				services: []rmetadata.Service{},
+			},
+		},
+		untouched: []string{"vs-manual", "vs-other-env", "vs-other-instance", "vs-other-suffix"},
+	},
+	{
+		name: "owner records",
+		initial: []model.LBConfig{
+			legacyConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1"),
+			legacyConfig("vs-api", poolName("api", "app"), "9090", "10.0.0.2"),
+			// owned by its record although the pool name has no suffix
+			testConfig("vs-old", "renamed-pool", "8080", "10.0.0.3"),
+		},
+		steps: []reconcileStep{
+			{
+				name: "objects created without a record are adopted",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+					testService("api", "app", "vs-api", "9090", "10.0.0.2", "10.0.0.4"),
+				},
+				wantCalls: []string{"REMOVE vs-old", "ADD_TARGETS vs-api", "SET_OWNER vs-api", "SET_OWNER vs-web"},
+			},
+			{
+				name: "recreated service",
+				services: func() []rmetadata.Service {
+					web := testService("web", "app", "vs-web", "8080", "10.0.0.1")
+					web.UUID = "uuid-2"
+					return []rmetadata.Service{web, testService("api", "app", "vs-api", "9090", "10.0.0.2", "10.0.0.4")}
+				}(),
+				wantCalls: []string{"SET_OWNER vs-web"},
+			},
+			{
+				name: "in sync",
+				services: func() []rmetadata.Service {
+					web := testService("web", "app", "vs-web", "8080", "10.0.0.1")
+					web.UUID = "uuid-2"
+					return []rmetadata.Service{web, testService("api", "app", "vs-api", "9090", "10.0.0.2", "10.0.0.4")}
+				}(),
+			},
+		},
+	},
+	{
+		name: "container state filtering",
+		steps: []reconcileStep{
+			{
+				name: "one unhealthy container",
+				services: func() []rmetadata.Service {
+					svc := testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+					svc.Containers[1].HealthState = "unhealthy"
+					svc.Containers[2].State = "stopped"
+					return []rmetadata.Service{svc}
+				}(),
+				wantCalls: []string{"ADD vs-web"},
+			},
+			{
+				name: "container becomes healthy",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.2", "10.0.0.3"),
+				},
+				wantCalls: []string{"ADD_TARGETS vs-web"},
+			},
+		},
+	},
+	{
+		name: "duplicate endpoint label",
+		steps: []reconcileStep{
+			{
+				name: "second service is skipped",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+					testService("web2", "app", "vs-web", "8081", "10.0.0.2"),
+				},
+				wantCalls: []string{"ADD vs-web"},
+			},
+		},
+	},
+	{
+		name:        "fqdn is reported",
+		fqdn:        "lb.example.com",
+		fullUpdates: true,
+		initial: []model.LBConfig{
+			testConfig("vs-api", poolName("api", "app"), "9090", "10.0.0.2"),
+		},
+		steps: []reconcileStep{
+			{
+				name: "add and update",
+				services: []rmetadata.Service{
+					testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+					testService("api", "app", "vs-api", "9090", "10.0.0.2", "10.0.0.3"),
+				},
+				wantCalls: []string{"ADD vs-web", "UPDATE vs-api"},
+				wantFqdns: []string{"vs-api.lb.example.com", "vs-web.lb.example.com"},
+			},
+		},
+	},
+	{
+		name: "fqdn is reported on target updates",
+		fqdn: "lb.example.com",
+		initial: []model.LBConfig{
+			testConfig("vs-api", poolName("api", "app"), "9090", "10.0.0.2"),
+		},
+		steps: []reconcileStep{
+			{
+				name: "add targets",
+				services: []rmetadata.Service{
+					testService("api", "app", "vs-api", "9090", "10.0.0.2", "10.0.0.3"),
+				},
+				wantCalls: []string{"ADD_TARGETS vs-api"},
+				wantFqdns: []string{"vs-api.lb.example.com"},
+			},
+		},
+	},
+}
+
+func TestUpdateProviderLBConfigs(t *testing.T) {
+	for _, test := range reconcileTests {
+		mem := memory.NewMemoryProvider()
+		mem.FqdnSuffix = test.fqdn
+		mem.SetLBConfigs(test.initial...)
+		fake := &fakeMetadata{}
+		setTestGlobals(mem, fake)
+		if test.fullUpdates {
+			lbProviders = []*lbProvider{newLBProvider("memory", fullUpdateProvider{mem})}
+		}
+
+		for _, step := range test.steps {
+			fake.services = step.services
+			mem.Reset()
+
+			metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+			if err != nil {
+				t.Fatalf("%s/%s: GetMetadataLBConfigs: %v", test.name, step.name, err)
+			}
+
+			updated, err := UpdateProviderLBConfigs(metadataConfigs)
+			if err != nil {
+				t.Fatalf("%s/%s: UpdateProviderLBConfigs: %v", test.name, step.name, err)
+			}
+
+			if got := callStrings(mem.Calls()); !equalStrings(got, step.wantCalls) {
+				t.Errorf("%s/%s: provider calls = %v, want %v", test.name, step.name, got, step.wantCalls)
+			}
+
+			var fqdns []string
+			for fqdn := range updated {
+				fqdns = append(fqdns, fqdn)
+			}
+			sort.Strings(fqdns)
+			if !equalStrings(fqdns, step.wantFqdns) {
+				t.Errorf("%s/%s: updated FQDNs = %v, want %v", test.name, step.name, fqdns, step.wantFqdns)
+			}
+
+			// a second pass over the same snapshot must be a no-op
+			mem.Reset()
+			if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+				t.Fatalf("%s/%s: second UpdateProviderLBConfigs: %v", test.name, step.name, err)
+			}
+			if got := callStrings(mem.Calls()); len(got) != 0 {
+				t.Errorf("%s/%s: not converged, second pass made calls %v", test.name, step.name, got)
+			}
+
+			assertProviderState(t, test.name+"/"+step.name, mem, metadataConfigs, test.untouched)
+		}
+	}
+}
+
+func TestMultipleProviders(t *testing.T) {
+	memA := memory.NewMemoryProvider()
+	memB := memory.NewMemoryProvider()
+	// vs-web is moving from b to the default provider
+	memB.SetLBConfigs(testConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1"))
+
+	api := testService("api", "app", "vs-api", "9090", "10.0.0.2")
+	api.Labels[serviceLabelProvider] = "b"
+	typo := testService("db", "app", "vs-db", "5432", "10.0.0.3")
+	typo.Labels[serviceLabelProvider] = "c"
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+		api,
+		typo,
+	}}
+	setTestGlobals(memA, fake)
+	lbProviders = []*lbProvider{newLBProvider("a", memA), newLBProvider("b", memB)}
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := callStrings(memA.Calls()), []string{"ADD vs-web"}; !equalStrings(got, want) {
+		t.Errorf("provider a calls = %v, want %v", got, want)
+	}
+	if got, want := callStrings(memB.Calls()), []string{"REMOVE vs-web", "ADD vs-api"}; !equalStrings(got, want) {
+		t.Errorf("provider b calls = %v, want %v", got, want)
+	}
+
+	for _, status := range endpointStatus.List() {
+		want := map[string]string{"vs-api": "b", "vs-web": "a"}[status.Endpoint]
+		if status.Provider != want {
+			t.Errorf("endpoint %s: provider = %q, want %q", status.Endpoint, status.Provider, want)
+		}
+	}
+}
+
+func TestTargetWeights(t *testing.T) {
+	const weightLabel = "io.rancher.service.external_lb.weight"
+	mem := memory.NewMemoryProvider()
+	web := testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	web.Labels[weightLabel] = "2"
+	web.Containers[0].Labels = map[string]string{weightLabel: "10"}
+	web.Containers[1].HostUUID = "host-large"
+	fake := &fakeMetadata{
+		services: []rmetadata.Service{web},
+		hosts: []rmetadata.Host{
+			{UUID: "host-large", Labels: map[string]string{weightLabel: "5"}},
+		},
+	}
+	setTestGlobals(mem, fake)
+
+	reconcile := func() []string {
+		mem.Reset()
+		metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+			t.Fatal(err)
+		}
+		return callStrings(mem.Calls())
+	}
+
+	if got, want := reconcile(), []string{"ADD vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	want := testConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	// the container label wins over the host label, which wins over the service label
+	want.LBTargets[0].Weight = 10
+	want.LBTargets[1].Weight = 5
+	want.LBTargets[2].Weight = 2
+	want.Scale = web.Scale
+	assertProviderState(t, "weighted", mem, map[string]model.LBConfig{"vs-web": want}, nil)
+
+	fake.hosts[0].Labels[weightLabel] = "8"
+	if got, want := reconcile(), []string{"WEIGHT_TARGETS vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls after changing the host weight = %v, want %v", got, want)
+	}
+	if got := reconcile(); len(got) != 0 {
+		t.Errorf("calls = %v, want none", got)
+	}
+}
+
+func TestMultiPortServices(t *testing.T) {
+	// multiPortService publishes ports 80 and 443 on every host
+	multiPortService := func(name, label string, hostIPs ...string) rmetadata.Service {
+		svc := testService(name, "app", label, "80", hostIPs...)
+		svc.Ports = []string{"80:80/tcp", "443:443/tcp"}
+		for i, ip := range hostIPs {
+			svc.Containers[i].Ports = []string{ip + ":80:80/tcp", ip + ":443:443/tcp"}
+		}
+		return svc
+	}
+	mem := memory.NewMemoryProvider()
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		multiPortService("web", "vs-https:443,vs-http:80", "10.0.0.1"),
+		multiPortService("api", "vs-api:443, vs-api:80", "10.0.0.2"),
+		multiPortService("bad", "vs-bad:8080", "10.0.0.3"),
+	}}
+	setTestGlobals(mem, fake)
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := testConfig("vs-api", poolName("api", "app"), "443")
+	api.Ports = []string{"443", "80"}
+	api.LBTargets = []model.LBTarget{
+		testTarget("10.0.0.2", "80"),
+		testTarget("10.0.0.2", "443"),
+	}
+	want := map[string]model.LBConfig{
+		"vs-https": testConfig("vs-https", poolName("web", "app"), "443", "10.0.0.1"),
+		"vs-http":  testConfig("vs-http", poolName("web", "app"), "80", "10.0.0.1"),
+		"vs-api":   api,
+	}
+	if !reflect.DeepEqual(metadataConfigs, want) {
+		t.Errorf("configs = %v, want %v", metadataConfigs, want)
+	}
+
+	// a provider registering whole hosts gets each host once
+	p := newLBProvider("hosts", capsProvider{mem, providers.Capabilities{}})
+	got, err := checkCapabilities(p, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []model.LBTarget{testTarget("10.0.0.2", "443")}; !reflect.DeepEqual(got.LBTargets, want) {
+		t.Errorf("whole host targets = %v, want %v", got.LBTargets, want)
+	}
+}
+
+func TestTrafficSplit(t *testing.T) {
+	const trafficLabel = "io.rancher.service.external_lb.traffic_weight"
+	blue := testService("blue", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	blue.Labels[trafficLabel] = "90"
+	blue.Scale = 3
+	green := testService("green", "app", "vs-web", "8081", "10.0.0.4")
+	green.Labels[trafficLabel] = "10"
+	green.Scale = 1
+	// services without a traffic weight cannot join the split
+	other := testService("other", "app", "vs-web", "8082", "10.0.0.5")
+	mem := memory.NewMemoryProvider()
+	fake := &fakeMetadata{services: []rmetadata.Service{green, other, blue}}
+	setTestGlobals(mem, fake)
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig("vs-web", "vs-web_"+testEnvUUID+"_"+testSuffix, "8080", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	want.LBTargets = append(want.LBTargets, testTarget("10.0.0.4", "8081"))
+	// each blue target gets 30% of the traffic, the green one 10%
+	for i, weight := range []int{100, 100, 100, 33} {
+		want.LBTargets[i].Weight = weight
+	}
+	want.Ports = []string{"8080", "8081"}
+	want.Scale = 4
+	want.Services = []model.ServiceRef{{Stack: "app", Name: "blue"}, {Stack: "app", Name: "green"}}
+	if !reflect.DeepEqual(metadataConfigs, map[string]model.LBConfig{"vs-web": want}) {
+		t.Errorf("configs = %v, want %v", metadataConfigs, want)
+	}
+
+	// weights are scaled down to the maximum of the provider
+	p := newLBProvider("max10", capsProvider{mem, providers.Capabilities{TargetPorts: true, Weights: true, MaxWeight: 10}})
+	got, err := checkCapabilities(p, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var weights []int
+	for _, target := range got.LBTargets {
+		weights = append(weights, target.Weight)
+	}
+	if !reflect.DeepEqual(weights, []int{10, 10, 10, 3}) {
+		t.Errorf("scaled weights = %v, want [10 10 10 3]", weights)
+	}
+
+	p = newLBProvider("unweighted", capsProvider{mem, providers.Capabilities{TargetPorts: true}})
+	if _, err := checkCapabilities(p, want); err == nil {
+		t.Error("traffic split was accepted by a provider without weights")
+	}
+}
+
+// fullUpdateProvider exposes only the methods of providers.Provider.
+type fullUpdateProvider struct {
+	providers.Provider
+}
+
+func TestUDPServices(t *testing.T) {
+	// dnsService publishes port 53 for both TCP and UDP on every host
+	dnsService := func(name, label string, hostIPs ...string) rmetadata.Service {
+		svc := testService(name, "app", label, "53", hostIPs...)
+		svc.Ports = []string{"53:53/udp", "53:53/tcp"}
+		for i, ip := range hostIPs {
+			svc.Containers[i].Ports = []string{ip + ":53:53/udp", ip + ":53:53/tcp"}
+		}
+		return svc
+	}
+	mem := memory.NewMemoryProvider()
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		dnsService("dns", "vs-dns:53/udp,vs-dns-tcp:53", "10.0.0.1"),
+		dnsService("legacy", "vs-legacy", "10.0.0.2"),
+		dnsService("mixed", "vs-mixed:53/udp,vs-mixed:53/tcp", "10.0.0.3"),
+	}}
+	setTestGlobals(mem, fake)
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := func(endpoint, service, ip string) model.LBConfig {
+		config := testConfig(endpoint, poolName(service, "app"), "53")
+		config.Protocol = model.ProtocolUDP
+		config.LBTargets = []model.LBTarget{testTarget(ip, "53")}
+		config.LBTargets[0].Protocol = model.ProtocolUDP
+		return config
+	}
+	want := map[string]model.LBConfig{
+		"vs-dns":     udp("vs-dns", "dns", "10.0.0.1"),
+		"vs-dns-tcp": testConfig("vs-dns-tcp", poolName("dns", "app"), "53", "10.0.0.1"),
+		"vs-legacy":  udp("vs-legacy", "legacy", "10.0.0.2"),
+	}
+	if !reflect.DeepEqual(metadataConfigs, want) {
+		t.Errorf("configs = %v, want %v", metadataConfigs, want)
+	}
+
+	p := newLBProvider("tcp", capsProvider{mem, providers.Capabilities{TargetPorts: true}})
+	if _, err := checkCapabilities(p, want["vs-dns"]); err == nil {
+		t.Error("UDP config was accepted by a provider without UDP support")
+	}
+	if _, err := checkCapabilities(p, want["vs-dns-tcp"]); err != nil {
+		t.Errorf("TCP config was rejected: %v", err)
+	}
+}
+
+func TestIPv6Services(t *testing.T) {
+	svc := testService("web", "app", "vs-web", "8080", "fd00::1", "fd00::2", "10.0.0.3")
+	svc.Containers[0].Ports = []string{"[fd00::1]:8080:80/tcp"}
+	svc.Containers[1].Ports = []string{"fd00:0::2:8080:80/tcp"}
+	mem := memory.NewMemoryProvider()
+	setTestGlobals(mem, &fakeMetadata{services: []rmetadata.Service{svc}})
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig("vs-web", poolName("web", "app"), "8080", "fd00::1", "fd00::2", "10.0.0.3")
+	if got := metadataConfigs["vs-web"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %v, want %v", got, want)
+	}
+	if got, want := want.LBTargets[0].String(), "([fd00::1]:8080)"; got != want {
+		t.Errorf("target = %s, want %s", got, want)
+	}
+}
+
+func TestContainerTargetMode(t *testing.T) {
+	// containerService has containers on a routed network
+	// that do not publish any ports
+	containerService := func(name, endpoint, mode string, containerIPs ...string) rmetadata.Service {
+		svc := testService(name, "app", endpoint, "8080", containerIPs...)
+		svc.Labels["io.rancher.service.external_lb.target_mode"] = mode
+		for i, ip := range containerIPs {
+			svc.Containers[i].PrimaryIp = ip
+			svc.Containers[i].Ports = nil
+		}
+		return svc
+	}
+	mem := memory.NewMemoryProvider()
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		containerService("web", "vs-web", "container", "10.42.0.1", "10.42.0.2"),
+		containerService("api", "vs-api:9000", "container", "10.42.0.3"),
+		containerService("bad", "vs-bad", "overlay", "10.42.0.4"),
+	}}
+	setTestGlobals(mem, fake)
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := testConfig("vs-web", poolName("web", "app"), "80", "10.42.0.1", "10.42.0.2")
+	web.TargetMode = model.TargetModeContainer
+	api := testConfig("vs-api", poolName("api", "app"), "9000", "10.42.0.3")
+	api.TargetMode = model.TargetModeContainer
+	want := map[string]model.LBConfig{"vs-web": web, "vs-api": api}
+	if !reflect.DeepEqual(metadataConfigs, want) {
+		t.Errorf("configs = %v, want %v", metadataConfigs, want)
+	}
+
+	p := newLBProvider("hosts", capsProvider{mem, providers.Capabilities{TargetPorts: true}})
+	if _, err := checkCapabilities(p, web); err == nil {
+		t.Error("container targets were accepted by a provider registering hosts")
+	}
+}
+
+func TestHostSelector(t *testing.T) {
+	web := testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	web.Labels["io.rancher.service.external_lb.host_selector"] = "lb-zone=dmz"
+	for i := range web.Containers {
+		web.Containers[i].HostUUID = fmt.Sprintf("host-%d", i+1)
+	}
+	// a port published on all addresses gets the agent IP of its host
+	web.Containers[2].Ports = []string{"0.0.0.0:8080:80/tcp"}
+	mem := memory.NewMemoryProvider()
+	fake := &fakeMetadata{
+		services: []rmetadata.Service{web},
+		hosts: []rmetadata.Host{
+			{UUID: "host-1", Labels: map[string]string{"lb-zone": "dmz"}},
+			{UUID: "host-2", Labels: map[string]string{"lb-zone": "dmz", "maintenance": "true"}},
+			{UUID: "host-3", AgentIP: "192.168.0.3", Labels: map[string]string{"lb-zone": "dmz"}},
+		},
+	}
+	setTestGlobals(mem, fake)
+	var err error
+	if m.HostSelector, err = metadata.ParseHostSelector("maintenance!=true"); err != nil {
+		t.Fatal(err)
+	}
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1", "192.168.0.3")
+	if got := metadataConfigs["vs-web"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %v, want %v", got, want)
+	}
+
+	// hosts without the zone label are not selected
+	fake.hosts[0].Labels = nil
+	metadataConfigs, _ = m.GetMetadataLBConfigs(targetPoolSuffix)
+	want = testConfig("vs-web", poolName("web", "app"), "8080", "192.168.0.3")
+	if got := metadataConfigs["vs-web"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %v, want %v", got, want)
+	}
+}
+
+func TestPoolNames(t *testing.T) {
+	// names without underscores and dots keep the format used before escaping
+	simple := model.PoolName{Service: model.ServiceRef{Stack: "app", Name: "web"}, Environment: testEnvUUID, Suffix: testSuffix}
+	if got := simple.String(); got != poolName("web", "app") {
+		t.Errorf("pool name = %s, want %s", got, poolName("web", "app"))
+	}
+
+	names := []model.PoolName{
+		simple,
+		{Service: model.ServiceRef{Stack: "my_app", Name: "web.v2"}, Environment: testEnvUUID, Suffix: testSuffix},
+		{Service: model.ServiceRef{Stack: "app", Name: "web_"}, Environment: testEnvUUID, Suffix: testSuffix},
+		{Endpoint: "vs_web.example.com", Environment: testEnvUUID, Suffix: testSuffix},
+	}
+	for _, name := range names {
+		parsed, err := model.ParsePoolName(name.String(), testSuffix)
+		if err != nil || parsed != name {
+			t.Errorf("ParsePoolName(%s) = %+v, %v, want %+v", name, parsed, err, name)
+		}
+	}
+
+	long := model.PoolName{
+		Service:     model.ServiceRef{Stack: "app", Name: strings.Repeat("web_", 40)},
+		Environment: testEnvUUID,
+		Suffix:      testSuffix,
+	}
+	other := long
+	other.Service.Name += "x"
+	if got := long.String(); len(got) > model.MaxPoolNameLength || got == other.String() {
+		t.Errorf("long pool name %s is not shortened to a unique name", got)
+	}
+	if _, err := model.ParsePoolName(long.String(), testSuffix); err != model.ErrHashedPoolName {
+		t.Errorf("ParsePoolName of a hashed name: err = %v, want %v", err, model.ErrHashedPoolName)
+	}
+
+	// a name created from a service with an underscore before escaping
+	if _, err := model.ParsePoolName("my_web_app_env1_rancher.internal", testSuffix); err == nil {
+		t.Error("an ambiguous legacy pool name was parsed")
+	}
+}
+
+func TestOwnerRecords(t *testing.T) {
+	owner := *testOwner("uuid-1")
+	if got := model.ParseOwner(owner.String()); got == nil || *got != owner {
+		t.Errorf("ParseOwner(%s) = %v, want %v", owner, got, owner)
+	}
+	if got := model.OwnerFromTags(owner.Tags()); got == nil || *got != owner {
+		t.Errorf("OwnerFromTags(%v) = %v, want %v", owner.Tags(), got, owner)
+	}
+	for _, description := range []string{"", "Web pool", "{}", `{"environment":"env1"}`} {
+		if got := model.ParseOwner(description); got != nil {
+			t.Errorf("ParseOwner(%s) = %v, want nil", description, got)
+		}
+	}
+	if got := model.OwnerFromTags(map[string]string{"Name": "web"}); got != nil {
+		t.Errorf("OwnerFromTags of unrelated tags = %v, want nil", got)
+	}
+}
+
+func setTestGlobals(p *memory.MemoryProvider, client rmetadata.Client) {
+	lbProviders = []*lbProvider{newLBProvider("memory", p)}
+	m = &metadata.MetadataClient{
+		MetadataClient:  client,
+		EnvironmentUUID: testEnvUUID,
+		InstanceID:      testSuffix,
+	}
+	targetPoolSuffix = testSuffix
+	retries = NewRetryQueue(defaultRetryBaseDelay, defaultRetryMaxDelay)
+	endpointStatus = newStatusStore()
+	elector = nil
+	guard = newRemovalGuard(0, 0)
+	drains = newDrainTracker(0)
+}
+
+// assertProviderState checks that the provider holds exactly the
+// metadata configs plus the configs external-lb does not own.
+func assertProviderState(t *testing.T, name string, p *memory.MemoryProvider,
+	want map[string]model.LBConfig, untouched []string) {
+	configs, _ := p.GetLBConfigs()
+	got := make(map[string]model.LBConfig)
+	for _, config := range configs {
+		// reported by the provider, not part of the desired state
+		config.FQDN = ""
+		got[config.LBEndpoint] = config
+	}
+	for _, endpoint := range untouched {
+		if _, ok := got[endpoint]; !ok {
+			t.Errorf("%s: unowned endpoint %s was removed", name, endpoint)
+		}
+		delete(got, endpoint)
+	}
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: provider state = %v, want %v", name, got, want)
+	}
+}
+
+func callStrings(calls []memory.Call) []string {
+	var s []string
+	for _, call := range calls {
+		s = append(s, call.String())
+	}
+	return s
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
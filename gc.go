@@ -0,0 +1,258 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+)
+
+var (
+	gcFlags        = flag.NewFlagSet("gc", flag.ExitOnError)
+	gcApply        = gcFlags.Bool("apply", false, "Delete the orphaned objects instead of only listing them")
+	gcInstance     = gcFlags.String("instance", "", "Instance ID whose objects are collected, and pool name suffix of objects without owner record, e.g. a former LB_TARGET_RANCHER_SUFFIX; defaults to this instance")
+	gcEnvironments = gcFlags.String("environments", "", "Comma separated UUIDs of deleted environments whose objects with the same instance ID are collected as well")
+	gcForce        = gcFlags.Bool("force", false, "Delete the orphaned endpoints even if they exceed the removal limits or metadata lists no services")
+)
+
+// orphan is an object on a provider that external-lb created for an
+// environment, service or endpoint that no longer exists.
+type orphan struct {
+	provider *lbProvider
+	// config is the config of the endpoint, or of a pool not assigned
+	// to any endpoint if LBEndpoint is empty
+	config model.LBConfig
+	reason string
+}
+
+func (o orphan) String() string {
+	if o.config.LBEndpoint == "" {
+		return fmt.Sprintf("pool %s", o.config.LBTargetPoolName)
+	}
+	return fmt.Sprintf("endpoint %s (pool %s)", o.config.LBEndpoint, o.config.LBTargetPoolName)
+}
+
+// gcScope holds what is known to exist when collecting orphans.
+type gcScope struct {
+	instance string
+	// suffix of the pool names of objects without owner record
+	suffix string
+	// UUIDs of the deleted environments whose objects are collected
+	environments map[string]bool
+	// UUIDs of the services in metadata
+	services map[string]bool
+	// names of the services in metadata
+	refs map[model.ServiceRef]bool
+	// endpoints of the metadata configs
+	endpoints map[string]bool
+}
+
+// runGC lists the orphaned objects on all providers, and deletes them
+// if apply is set.
+func runGC(w io.Writer, apply bool) error {
+	scope, err := newGCScope()
+	if err != nil {
+		return err
+	}
+	orphans, plans, err := collectOrphans(scope)
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) == 0 {
+		fmt.Fprintln(w, "No orphaned objects")
+		return nil
+	}
+	for _, o := range orphans {
+		fmt.Fprintf(w, "%s on provider %s: %s\n", o, o.provider.slug, o.reason)
+	}
+	if !apply {
+		fmt.Fprintf(w, "%d orphaned objects, run with --apply to delete them\n", len(orphans))
+		return nil
+	}
+	if !*gcForce {
+		if err := checkRemovalLimits(scope, plans); err != nil {
+			return err
+		}
+	}
+
+	var failed int
+	for _, o := range orphans {
+		if err := o.remove(); err != nil {
+			failed++
+			fmt.Fprintf(w, "Failed to delete %s: %v\n", o, err)
+			continue
+		}
+		fmt.Fprintf(w, "Deleted %s\n", o)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d orphaned objects could not be deleted", failed, len(orphans))
+	}
+	return nil
+}
+
+func newGCScope() (*gcScope, error) {
+	services, err := m.MetadataClient.GetServices()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading services: %v", err)
+	}
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get LB configs from metadata: %v", err)
+	}
+
+	scope := &gcScope{
+		instance:     *gcInstance,
+		environments: make(map[string]bool),
+		services:     make(map[string]bool, len(services)),
+		refs:         make(map[model.ServiceRef]bool, len(services)),
+		endpoints:    make(map[string]bool, len(metadataConfigs)),
+	}
+	scope.suffix = scope.instance
+	if scope.instance == "" {
+		scope.instance, scope.suffix = m.InstanceID, targetPoolSuffix
+	}
+	for _, environment := range strings.Split(*gcEnvironments, ",") {
+		if environment = strings.TrimSpace(environment); environment == "" {
+			continue
+		}
+		if environment == m.EnvironmentUUID {
+			return nil, fmt.Errorf("Environment %s is the current environment, it cannot be collected", environment)
+		}
+		scope.environments[environment] = true
+	}
+	for _, service := range services {
+		scope.services[service.UUID] = true
+		scope.refs[model.ServiceRef{Stack: service.StackName, Name: service.Name}] = true
+	}
+	for endpoint := range metadataConfigs {
+		scope.endpoints[endpoint] = true
+	}
+	return scope, nil
+}
+
+// collectOrphans returns the orphaned endpoint configs and detached pools
+// of all providers, in the order in which they are listed by the providers.
+// It also returns a plan per provider removing the orphaned endpoints from
+// the endpoints of the instance, for checking the removal limits.
+func collectOrphans(scope *gcScope) ([]orphan, []*Plan, error) {
+	var orphans []orphan
+	var plans []*Plan
+	for _, p := range lbProviders {
+		configs, err := p.GetLBConfigs()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get LB configs from provider %s: %v", p.slug, err)
+		}
+		if collector, ok := p.Provider.(providers.PoolCollector); ok {
+			pools, err := collector.GetDetachedPools(scope.suffix)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Failed to get pools from provider %s: %v", p.slug, err)
+			}
+			configs = append(configs, pools...)
+		}
+
+		plan := &Plan{provider: p, current: make(map[string]model.LBConfig)}
+		for _, config := range configs {
+			reason, owned, ok := scope.orphaned(config)
+			if owned && config.LBEndpoint != "" {
+				plan.current[config.LBEndpoint] = config
+			}
+			if !ok {
+				continue
+			}
+			orphans = append(orphans, orphan{provider: p, config: config, reason: reason})
+			if config.LBEndpoint != "" {
+				plan.Remove = append(plan.Remove, config)
+			}
+		}
+		plans = append(plans, plan)
+	}
+	return orphans, plans, nil
+}
+
+// checkRemovalLimits returns an error if removing the orphaned endpoints
+// exceeds the limits of the removal guard on any provider, or if metadata
+// lists no services at all while there are endpoints to remove. Like for
+// updates, these usually mean that metadata returned an incomplete list of
+// services.
+func checkRemovalLimits(scope *gcScope, plans []*Plan) error {
+	for _, plan := range plans {
+		if len(plan.Remove) == 0 {
+			continue
+		}
+		if len(scope.services) == 0 {
+			return fmt.Errorf("Refusing to delete %d endpoints on provider %s: metadata lists no services, run with --force if this is expected",
+				len(plan.Remove), plan.provider.slug)
+		}
+		if reason := guard.exceedsLimits(plan); reason != "" {
+			return fmt.Errorf("Refusing to delete the orphaned objects on provider %s: %s, run with --force if this is expected",
+				plan.provider.slug, reason)
+		}
+	}
+	return nil
+}
+
+// orphaned returns the reason why the config is orphaned, if it is. Only
+// configs of the instance are considered: by their owner record, or by
+// their pool name for objects created before owner records. It also
+// returns whether the config belongs to the instance and to an environment
+// within the scope.
+func (s *gcScope) orphaned(config model.LBConfig) (reason string, owned, ok bool) {
+	var owner model.Owner
+	var ref model.ServiceRef
+	var endpoint string
+	if config.Owner != nil {
+		owner = *config.Owner
+	} else {
+		name, err := model.ParsePoolName(config.LBTargetPoolName, s.suffix)
+		if err != nil {
+			logrus.Debugf("Skipping pool %s without owner record: %v", config.LBTargetPoolName, err)
+			return "", false, false
+		}
+		owner = model.Owner{Environment: name.Environment, Instance: s.instance}
+		ref, endpoint = name.Service, name.Endpoint
+	}
+
+	switch {
+	case owner.Instance != s.instance:
+		return "", false, false
+	case owner.Environment != m.EnvironmentUUID:
+		// only environments listed as deleted, as others may share
+		// the provider with the same instance ID
+		if !s.environments[owner.Environment] {
+			return "", false, false
+		}
+		return fmt.Sprintf("environment %s was deleted", owner.Environment), true, true
+	case config.LBEndpoint == "":
+		return "pool is not assigned to an endpoint", true, true
+	case owner.Service != "":
+		if !s.services[owner.Service] {
+			return fmt.Sprintf("service %s no longer exists", owner.Service), true, true
+		}
+	case ref.Name != "":
+		if !s.refs[ref] {
+			return fmt.Sprintf("service %s no longer exists", ref), true, true
+		}
+	default:
+		// endpoint shared by services splitting its traffic
+		if endpoint == "" {
+			endpoint = config.LBEndpoint
+		}
+		if !s.endpoints[endpoint] {
+			return fmt.Sprintf("endpoint %s is no longer used", endpoint), true, true
+		}
+	}
+	return "", true, false
+}
+
+// remove deletes the orphan from its provider.
+func (o orphan) remove() error {
+	if o.config.LBEndpoint == "" {
+		return o.provider.Provider.(providers.PoolCollector).RemoveDetachedPool(o.config)
+	}
+	return o.provider.RemoveLBConfig(o.config)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// poolProvider is a memory provider that also keeps
+// pools not assigned to any endpoint.
+type poolProvider struct {
+	*memory.MemoryProvider
+	pools   []model.LBConfig
+	removed []string
+}
+
+func (p *poolProvider) GetDetachedPools(suffix string) ([]model.LBConfig, error) {
+	return p.pools, nil
+}
+
+func (p *poolProvider) RemoveDetachedPool(config model.LBConfig) error {
+	p.removed = append(p.removed, config.LBTargetPoolName)
+	return nil
+}
+
+func TestGarbageCollection(t *testing.T) {
+	web := testService("web", "app", "vs-web", "8080", "10.0.0.1")
+	web.UUID = "uuid-web"
+	mem := memory.NewMemoryProvider()
+	setTestGlobals(mem, &fakeMetadata{services: []rmetadata.Service{web}})
+	pools := &poolProvider{MemoryProvider: mem, pools: []model.LBConfig{
+		{LBTargetPoolName: poolName("old", "app")},
+		{LBTargetPoolName: "manual-pool"},
+	}}
+	lbProviders = []*lbProvider{newLBProvider("memory", pools)}
+
+	owned := func(endpoint, pool, service string) model.LBConfig {
+		config := testConfig(endpoint, pool, "8080", "10.0.0.1")
+		config.Owner = testOwner(service)
+		return config
+	}
+	otherEnv := owned("vs-other-env", poolName("web", "app"), "uuid-web")
+	otherEnv.Owner.Environment = "env2"
+	// environments sharing the provider are live unless listed as deleted
+	liveEnv := owned("vs-live-env", poolName("web", "app"), "uuid-web")
+	liveEnv.Owner.Environment = "env3"
+	otherInstance := owned("vs-other-instance", "blue-pool", "uuid-gone")
+	otherInstance.Owner.Instance = "blue"
+	mem.SetLBConfigs(
+		owned("vs-web", poolName("web", "app"), "uuid-web"),
+		owned("vs-gone", "renamed-pool", "uuid-gone"),
+		legacyConfig("vs-legacy", poolName("api", "app"), "8080", "10.0.0.2"),
+		legacyConfig("vs-legacy-live", poolName("web", "app"), "8080", "10.0.0.1"),
+		legacyConfig("vs-manual", "manual-pool", "8080", "10.0.0.3"),
+		otherEnv,
+		liveEnv,
+		otherInstance,
+	)
+
+	var out bytes.Buffer
+	if err := runGC(&out, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"endpoint vs-gone (pool renamed-pool) on provider memory: service uuid-gone no longer exists",
+		"endpoint vs-legacy (pool api_app_env1_rancher.internal) on provider memory: service app/api no longer exists",
+		"pool old_app_env1_rancher.internal on provider memory: pool is not assigned to an endpoint",
+		"3 orphaned objects, run with --apply to delete them",
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); !equalStrings(got, want) {
+		t.Errorf("gc output = %q, want %q", got, want)
+	}
+	if calls := mem.Calls(); len(calls) != 0 || len(pools.removed) != 0 {
+		t.Errorf("gc without --apply changed the provider: %v, removed pools %v", calls, pools.removed)
+	}
+
+	*gcEnvironments = "env2"
+	defer func() { *gcEnvironments = "" }()
+	out.Reset()
+	if err := runGC(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	wantCalls := []string{"REMOVE vs-gone", "REMOVE vs-legacy", "REMOVE vs-other-env"}
+	if got := callStrings(mem.Calls()); !equalStrings(got, wantCalls) {
+		t.Errorf("provider calls = %v, want %v", got, wantCalls)
+	}
+	if want := []string{poolName("old", "app")}; !equalStrings(pools.removed, want) {
+		t.Errorf("removed pools = %v, want %v", pools.removed, want)
+	}
+	if !strings.Contains(out.String(), "Deleted endpoint vs-other-env") {
+		t.Errorf("gc output does not report the deletion of vs-other-env:\n%s", out.String())
+	}
+}
+
+func TestGarbageCollectionLimits(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+	}}
+	setTestGlobals(mem, fake)
+	guard = newRemovalGuard(1, 0)
+	mem.SetLBConfigs(
+		legacyConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1"),
+		legacyConfig("vs-api", poolName("api", "app"), "8080", "10.0.0.2"),
+		legacyConfig("vs-db", poolName("db", "app"), "8080", "10.0.0.3"),
+	)
+
+	var out bytes.Buffer
+	if err := runGC(&out, true); err == nil {
+		t.Error("gc removing 2 endpoints with a limit of 1 succeeded")
+	}
+	if calls := mem.Calls(); len(calls) != 0 {
+		t.Errorf("gc exceeding the limits changed the provider: %v", calls)
+	}
+
+	// an empty list of services is refused even without limits
+	guard = newRemovalGuard(0, 0)
+	fake.services = nil
+	if err := runGC(&out, true); err == nil {
+		t.Error("gc with no services in metadata succeeded")
+	}
+	if calls := mem.Calls(); len(calls) != 0 {
+		t.Errorf("gc with no services in metadata changed the provider: %v", calls)
+	}
+
+	*gcForce = true
+	defer func() { *gcForce = false }()
+	if err := runGC(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	wantCalls := []string{"REMOVE vs-api", "REMOVE vs-db", "REMOVE vs-web"}
+	if got := callStrings(mem.Calls()); !equalStrings(got, wantCalls) {
+		t.Errorf("provider calls with --force = %v, want %v", got, wantCalls)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+)
+
+// removalGuard blocks changes that remove more than expected in a single
+// update. These usually mean that metadata returned an incomplete list of
+// services rather than that the services are really gone.
+type removalGuard struct {
+	// maxEndpoints is the number of endpoints a provider may lose in one
+	// update, 0 for no limit.
+	maxEndpoints int
+	// maxTargetPercent is the percentage by which the number of targets
+	// of a provider may shrink in one update, 0 for no limit.
+	maxTargetPercent float64
+
+	mu sync.Mutex
+	// blocked changes keyed by provider slug
+	blocked map[string][]string
+	// approved lets the next update bypass the limits
+	approved bool
+}
+
+func newRemovalGuard(maxEndpoints int, maxTargetPercent float64) *removalGuard {
+	return &removalGuard{
+		maxEndpoints:     maxEndpoints,
+		maxTargetPercent: maxTargetPercent,
+		blocked:          make(map[string][]string),
+	}
+}
+
+// Check removes the updates that would empty the pool of a service whose
+// scale is not 0 from the plan. It returns an error if the plan as a whole
+// exceeds the removal limits and must not be applied.
+func (g *removalGuard) Check(plan *Plan) error {
+	var blocked []string
+	var updates []model.LBConfig
+	for _, config := range plan.Update {
+		current := plan.current[config.LBEndpoint]
+		if len(config.LBTargets) == 0 && len(current.LBTargets) > 0 && config.Scale != 0 {
+			reason := fmt.Sprintf("refusing to remove all %d targets of endpoint %s, its service has scale %d",
+				len(current.LBTargets), config.LBEndpoint, config.Scale)
+			logrus.Errorf("Blocked update on provider %s: %s", plan.provider.slug, reason)
+			blocked = append(blocked, reason)
+			continue
+		}
+		updates = append(updates, config)
+	}
+	plan.Update = updates
+
+	var err error
+	if reason := g.exceedsLimits(plan); reason != "" {
+		if g.isApproved() {
+			logrus.Warnf("Applying approved changes on provider %s: %s", plan.provider.slug, reason)
+		} else {
+			blocked = append(blocked, reason)
+			err = fmt.Errorf("Blocked all changes on provider %s: %s", plan.provider.slug, reason)
+		}
+	}
+
+	g.mu.Lock()
+	if len(blocked) > 0 {
+		g.blocked[plan.provider.slug] = blocked
+	} else {
+		delete(g.blocked, plan.provider.slug)
+	}
+	g.mu.Unlock()
+	return err
+}
+
+// exceedsLimits returns why the plan exceeds the removal limits,
+// or an empty string if it does not.
+func (g *removalGuard) exceedsLimits(plan *Plan) string {
+	if g.maxEndpoints > 0 && len(plan.Remove) > g.maxEndpoints {
+		return fmt.Sprintf("%d endpoints would be removed, more than the limit of %d",
+			len(plan.Remove), g.maxEndpoints)
+	}
+
+	if g.maxTargetPercent > 0 {
+		current := 0
+		for _, config := range plan.current {
+			current += len(config.LBTargets)
+		}
+		change := 0
+		for _, config := range plan.Add {
+			change += len(config.LBTargets)
+		}
+		for _, config := range plan.Update {
+			change += len(config.LBTargets) - len(plan.current[config.LBEndpoint].LBTargets)
+		}
+		for _, config := range plan.Remove {
+			change -= len(config.LBTargets)
+		}
+		if current > 0 && change < 0 {
+			if percent := float64(-change) * 100 / float64(current); percent > g.maxTargetPercent {
+				return fmt.Sprintf("the number of targets would shrink by %.0f%% from %d to %d, more than the limit of %g%%",
+					percent, current, current+change, g.maxTargetPercent)
+			}
+		}
+	}
+	return ""
+}
+
+// Approve lets the next update of each provider exceed the limits.
+func (g *removalGuard) Approve() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.approved = true
+}
+
+func (g *removalGuard) isApproved() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.approved
+}
+
+// clearApproval is called after every update, so that an approval
+// is only valid for a single update.
+func (g *removalGuard) clearApproval() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.approved = false
+}
+
+// Blocked returns the changes blocked in the last update,
+// prefixed with the provider slug.
+func (g *removalGuard) Blocked() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var list []string
+	for slug, reasons := range g.blocked {
+		for _, reason := range reasons {
+			list = append(list, slug+": "+reason)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
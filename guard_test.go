@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestRemovalGuard(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	initial := []model.LBConfig{
+		testConfig("vs-a", poolName("a", "app"), "8080", "10.0.0.1", "10.0.0.2"),
+		testConfig("vs-b", poolName("b", "app"), "8081", "10.0.0.1", "10.0.0.2"),
+		testConfig("vs-c", poolName("c", "app"), "8082", "10.0.0.1", "10.0.0.2"),
+	}
+	mem.SetLBConfigs(initial...)
+	fake := &fakeMetadata{}
+	setTestGlobals(mem, fake)
+	guard = newRemovalGuard(1, 50)
+
+	reconcile := func(wantErr bool) []string {
+		mem.Reset()
+		metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := UpdateProviderLBConfigs(metadataConfigs); (err != nil) != wantErr {
+			t.Errorf("UpdateProviderLBConfigs error = %v, want error: %t", err, wantErr)
+		}
+		return callStrings(mem.Calls())
+	}
+
+	// metadata returning no services must not remove anything
+	fake.services = []rmetadata.Service{}
+	if got := reconcile(true); len(got) != 0 {
+		t.Errorf("calls with empty metadata = %v, want none", got)
+	}
+	if blocked := guard.Blocked(); len(blocked) != 1 ||
+		blocked[0] != "memory: 3 endpoints would be removed, more than the limit of 1" {
+		t.Errorf("blocked = %v", blocked)
+	}
+
+	// shrinking one pool by 3 of 6 targets is within the limits
+	fake.services = []rmetadata.Service{
+		testService("a", "app", "vs-a", "8080", "10.0.0.1"),
+		testService("b", "app", "vs-b", "8081", "10.0.0.1"),
+		testService("c", "app", "vs-c", "8082", "10.0.0.1"),
+	}
+	if got, want := reconcile(false), []string{"REMOVE_TARGETS vs-a", "REMOVE_TARGETS vs-b", "REMOVE_TARGETS vs-c"}; !equalStrings(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	if blocked := guard.Blocked(); len(blocked) != 0 {
+		t.Errorf("blocked after successful update = %v", blocked)
+	}
+
+	// removing two of three endpoints exceeds both limits until approved
+	fake.services = fake.services[:1]
+	if got := reconcile(true); len(got) != 0 {
+		t.Errorf("calls = %v, want none", got)
+	}
+	guard.Approve()
+	if got, want := reconcile(false), []string{"REMOVE vs-b", "REMOVE vs-c"}; !equalStrings(got, want) {
+		t.Errorf("calls after approval = %v, want %v", got, want)
+	}
+}
+
+func TestRemovalGuardEmptyPool(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(testConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1"))
+	web := testService("web", "app", "vs-web", "8080", "10.0.0.1")
+	web.Containers[0].HealthState = "unhealthy"
+	web.Scale = 1
+	fake := &fakeMetadata{services: []rmetadata.Service{web}}
+	setTestGlobals(mem, fake)
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err == nil {
+		t.Error("emptying the pool of a scaled service was not reported")
+	}
+	if calls := mem.Calls(); len(calls) != 0 {
+		t.Errorf("calls = %v, want none", calls)
+	}
+
+	// a service scaled to 0 may have an empty pool
+	web.Scale = 0
+	fake.services = []rmetadata.Service{web}
+	metadataConfigs, _ = m.GetMetadataLBConfigs(targetPoolSuffix)
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := callStrings(mem.Calls()), []string{"REMOVE_TARGETS vs-web"}; !equalStrings(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
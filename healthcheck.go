@@ -4,6 +4,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strings"
 )
 
 var (
@@ -13,6 +14,8 @@ var (
 
 func startHealthcheck() {
 	router.HandleFunc("/", healthcheck).Methods("GET", "HEAD").Name("Healthcheck")
+	router.Handle("/metrics", registry).Methods("GET").Name("Metrics")
+	registerAPIRoutes(router)
 	logrus.Info("Healthcheck handler is listening on ", healthcheckPort)
 	logrus.Fatal(http.ListenAndServe(healthcheckPort, router))
 }
@@ -24,12 +27,35 @@ func healthcheck(w http.ResponseWriter, req *http.Request) {
 		logrus.Errorf("Metadata health check failed: %v", err)
 		http.Error(w, "Failed to reach metadata server", http.StatusInternalServerError)
 	} else {
-		// 2) test provider
-		if err := provider.HealthCheck(); err != nil {
-			logrus.Errorf("Provider health check failed: %v", err)
-			http.Error(w, "Failed to reach external provider ", http.StatusInternalServerError)
+		// 2) test providers
+		if failed := checkProviders(); len(failed) > 0 {
+			http.Error(w, "Failed to reach external provider "+strings.Join(failed, ", "), http.StatusInternalServerError)
+		} else if !isLeader() {
+			// standbys are ready to take over but do not change the provider
+			w.Write([]byte("OK (standby)"))
 		} else {
 			w.Write([]byte("OK"))
 		}
+		// blocked changes need attention but do not make the service unhealthy
+		if blocked := guard.Blocked(); len(blocked) > 0 {
+			w.Write([]byte("\nBlocked changes:\n" + strings.Join(blocked, "\n")))
+		}
+	}
+}
+
+// checkProviders runs the health check of every provider and
+// returns the slugs of those that failed.
+func checkProviders() []string {
+	var failed []string
+	for _, p := range lbProviders {
+		if err := p.HealthCheck(); err != nil {
+			providerErrors.Inc(p.GetName(), "HEALTHCHECK")
+			providerUp.Set(0, p.GetName())
+			logrus.Errorf("Health check of provider %s failed: %v", p.slug, err)
+			failed = append(failed, p.slug)
+		} else {
+			providerUp.Set(1, p.GetName())
+		}
 	}
+	return failed
 }
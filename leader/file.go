@@ -0,0 +1,101 @@
+package leader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// FileLock is a Lock stored in a file on a volume shared by all replicas.
+// Access to the file is serialized with flock(2). The lease expiry is an
+// absolute time, so the clocks of the replicas' hosts must be in sync.
+type FileLock struct {
+	path string
+
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+}
+
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewFileLock returns a lock backed by the file at path.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path, now: time.Now}
+}
+
+func (l *FileLock) TryAcquire(id string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := l.update(func(current *lease) bool {
+		now := l.now()
+		if current.Holder != "" && current.Holder != id && now.Before(current.Expires) {
+			return false
+		}
+		current.Holder = id
+		current.Expires = now.Add(ttl)
+		acquired = true
+		return true
+	})
+	return acquired, err
+}
+
+func (l *FileLock) Release(id string) error {
+	return l.update(func(current *lease) bool {
+		if current.Holder != id {
+			return false
+		}
+		*current = lease{}
+		return true
+	})
+}
+
+// update calls fn with the lease read from the file while holding an
+// exclusive flock, and writes the lease back if fn returns true.
+func (l *FileLock) update(fn func(*lease) bool) error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("Failed to lock %s: %v", l.path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var current lease
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &current); err != nil {
+			logrus.Warnf("Ignoring invalid leader lease in %s: %v", l.path, err)
+			current = lease{}
+		}
+	}
+
+	if !fn(&current) {
+		return nil
+	}
+
+	data, err = json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,131 @@
+// Package leader implements lease based leader election, so that only one
+// of several external-lb replicas makes changes to the provider.
+package leader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Lock is a lease shared by all replicas. Implementations must make
+// TryAcquire and Release atomic across replicas.
+type Lock interface {
+	// TryAcquire acquires the lease for id, or renews it if id already
+	// holds it, so that it expires after ttl. It returns false if the
+	// lease is held by another id and has not expired yet.
+	TryAcquire(id string, ttl time.Duration) (bool, error)
+	// Release gives up the lease if it is held by id.
+	Release(id string) error
+}
+
+// Elector keeps trying to acquire the lock and renews it while leading.
+type Elector struct {
+	lock Lock
+	id   string
+	ttl  time.Duration
+
+	// onChange is called whenever the elector starts or stops leading.
+	onChange func(leading bool)
+
+	mu      sync.Mutex
+	leading bool
+	renewed time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewElector returns an elector competing for lock as id.
+// The lease is renewed every third of ttl.
+func NewElector(lock Lock, id string, ttl time.Duration, onChange func(leading bool)) *Elector {
+	return &Elector{
+		lock:     lock,
+		id:       id,
+		ttl:      ttl,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// ID returns the identity of this replica.
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// IsLeader returns true if this replica holds a lease that has not expired.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading && time.Since(e.renewed) < e.ttl
+}
+
+// Run competes for the lease until Stop is called.
+func (e *Elector) Run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.tryAcquire()
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops competing for the lease and releases it if held,
+// allowing another replica to take over without waiting for
+// the lease to expire.
+func (e *Elector) Stop() {
+	close(e.stop)
+	<-e.done
+	e.setLeading(false, time.Time{})
+	if err := e.lock.Release(e.id); err != nil {
+		logrus.Errorf("Failed to release leader lease: %v", err)
+	}
+}
+
+func (e *Elector) tryAcquire() {
+	now := time.Now()
+	ok, err := e.lock.TryAcquire(e.id, e.ttl)
+	if err != nil {
+		logrus.Errorf("Failed to acquire leader lease: %v", err)
+		// keep leading while the last renewed lease is still valid
+		if e.IsLeader() {
+			return
+		}
+		ok = false
+	}
+
+	if ok {
+		e.setLeading(true, now)
+	} else {
+		e.setLeading(false, time.Time{})
+	}
+}
+
+func (e *Elector) setLeading(leading bool, renewed time.Time) {
+	e.mu.Lock()
+	changed := e.leading != leading
+	e.leading = leading
+	if leading {
+		e.renewed = renewed
+	}
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if leading {
+		logrus.Infof("Replica %s is now the leader", e.id)
+	} else {
+		logrus.Infof("Replica %s is no longer the leader", e.id)
+	}
+	if e.onChange != nil {
+		e.onChange(leading)
+	}
+}
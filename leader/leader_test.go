@@ -0,0 +1,118 @@
+package leader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testFileLock(t *testing.T) (*FileLock, *time.Time, func()) {
+	dir, err := ioutil.TempDir("", "leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	lock := NewFileLock(filepath.Join(dir, "leader.lock"))
+	lock.now = func() time.Time { return now }
+	return lock, &now, func() { os.RemoveAll(dir) }
+}
+
+func tryAcquire(t *testing.T, lock Lock, id string, want bool) {
+	ok, err := lock.TryAcquire(id, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != want {
+		t.Fatalf("TryAcquire(%s) = %t, want %t", id, ok, want)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	lock, now, cleanup := testFileLock(t)
+	defer cleanup()
+
+	tryAcquire(t, lock, "a", true)
+	tryAcquire(t, lock, "b", false)
+
+	// renewing extends the lease of the holder
+	*now = now.Add(10 * time.Second)
+	tryAcquire(t, lock, "a", true)
+	*now = now.Add(10 * time.Second)
+	tryAcquire(t, lock, "b", false)
+
+	// b takes over once the lease has expired
+	*now = now.Add(5 * time.Second)
+	tryAcquire(t, lock, "b", true)
+	tryAcquire(t, lock, "a", false)
+
+	// releasing by a non-holder has no effect
+	if err := lock.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	tryAcquire(t, lock, "a", false)
+
+	if err := lock.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	tryAcquire(t, lock, "a", true)
+}
+
+func TestFileLockInvalidContent(t *testing.T) {
+	lock, _, cleanup := testFileLock(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(lock.path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tryAcquire(t, lock, "a", true)
+}
+
+func TestElector(t *testing.T) {
+	lock, _, cleanup := testFileLock(t)
+	defer cleanup()
+	lock.now = time.Now
+
+	changes := make(chan string, 10)
+	newElector := func(id string) *Elector {
+		return NewElector(lock, id, 300*time.Millisecond, func(leading bool) {
+			if leading {
+				changes <- id + " leading"
+			} else {
+				changes <- id + " standby"
+			}
+		})
+	}
+	expect := func(want string) {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	a := newElector("a")
+	go a.Run()
+	expect("a leading")
+	if !a.IsLeader() {
+		t.Fatal("a should be the leader")
+	}
+
+	b := newElector("b")
+	go b.Run()
+	time.Sleep(200 * time.Millisecond)
+	if b.IsLeader() {
+		t.Fatal("b should be on standby while a holds the lease")
+	}
+
+	// stopping a releases the lease and b takes over
+	a.Stop()
+	expect("a standby")
+	expect("b leading")
+	b.Stop()
+	expect("b standby")
+}
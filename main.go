@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"reflect"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/leader"
 	"github.com/rancher/external-lb/metadata"
 	"github.com/rancher/external-lb/model"
 	"github.com/rancher/external-lb/providers"
@@ -17,21 +22,43 @@ import (
 	_ "github.com/rancher/external-lb/providers/f5"
 )
 
-const (
-	pollInterval = 1000
-	// if metadata wasn't updated in 1 min, force update would be executed
-	forceUpdateInterval = 1
-)
-
 var (
-	providerName    = flag.String("provider", "f5_BigIP", "External LB  provider name")
+	providerNames   = flag.String("provider", "f5_BigIP", "Comma separated list of external LB provider names, the first one being the default")
 	debug           = flag.Bool("debug", false, "Debug")
 	logFile         = flag.String("log", "", "Log file")
 	metadataAddress = flag.String("metadata-address", "rancher-metadata", "The metadata service address")
+	dryRun          = flag.Bool("dry-run", false, "Log the changes that would be made to the provider without applying them")
+
+	metadataPollInterval = flag.Int("metadata-poll-interval", 1, "Interval in seconds for checking the metadata version")
+	resyncInterval       = flag.Duration("resync-interval", time.Minute, "Interval for forced updates of the provider")
+	resyncJitter         = flag.Float64("resync-jitter", 0.1, "Random delay added to the resync interval, as a fraction of it")
+	debounce             = flag.Duration("debounce", 2*time.Second, "Time to wait for further changes before updating the provider")
+	debounceMaxDelay     = flag.Duration("debounce-max-delay", 30*time.Second, "Maximum time continuous changes may delay an update of the provider")
+	retryBaseDelay       = flag.Duration("retry-base-delay", defaultRetryBaseDelay, "Delay before retrying a failed endpoint for the first time")
+	retryMaxDelay        = flag.Duration("retry-max-delay", defaultRetryMaxDelay, "Maximum delay between retries of a failed endpoint")
+
+	drainTimeout            = flag.Duration("drain-timeout", 0, "Time removed targets are drained before being deleted from providers that support it, 0 to delete them immediately")
+	maxEndpointRemovals     = flag.Int("max-endpoint-removals", 10, "Maximum number of endpoints removed from a provider in one update, 0 for no limit")
+	maxTargetRemovalPercent = flag.Float64("max-target-removal-percent", 50, "Maximum percentage by which the targets of a provider may shrink in one update, 0 for no limit")
+	hostSelector            = flag.String("host-selector", "", "Host labels selecting the hosts whose containers are targets, e.g. 'lb-zone=dmz,maintenance!=true'")
+	instanceID              = flag.String("instance-id", "", "Identifies this instance in the owner records of provider objects, defaults to LB_TARGET_RANCHER_SUFFIX")
+	targetPolicy            = flag.String("target-policy", "", "Container states that make targets, e.g. 'states=running;health=healthy,none;initializing-grace=60s;keep-unhealthy=true'")
+
+	leaderElect   = flag.String("leader-elect", "", "Leader election backend when running multiple replicas, 'file' or empty to disable")
+	leaderLock    = flag.String("leader-lock-file", "/var/lib/external-lb/leader.lock", "Lease file on a volume shared by all replicas, used by the 'file' backend")
+	leaseDuration = flag.Duration("leader-lease-duration", 15*time.Second, "Time after which a standby takes over if the leader stops renewing its lease")
 
-	provider providers.Provider
-	m        *metadata.MetadataClient
-	c        *CattleClient
+	m *metadata.MetadataClient
+	c *CattleClient
+
+	conflicts *conflictReporter
+
+	scheduler *Scheduler
+	retries   = NewRetryQueue(defaultRetryBaseDelay, defaultRetryMaxDelay)
+	guard     = newRemovalGuard(0, 0)
+	drains    = newDrainTracker(0)
+
+	endpointStatus = newStatusStore()
 
 	targetPoolSuffix        string
 	metadataLBConfigsCached = make(map[string]model.LBConfig)
@@ -39,6 +66,17 @@ var (
 
 func setEnv() {
 	flag.Parse()
+	switch flag.Arg(0) {
+	case "":
+	case "plan":
+		// plan is a one-shot dry run
+		*dryRun = true
+	case "gc":
+		gcFlags.Parse(flag.Args()[1:])
+	default:
+		logrus.Fatalf("Unknown command '%s'", flag.Arg(0))
+	}
+
 	if *debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
@@ -55,23 +93,68 @@ func setEnv() {
 		}
 	}
 
+	if *metadataPollInterval < 1 {
+		logrus.Fatalf("metadata-poll-interval must be at least 1 second")
+	}
+	if *resyncInterval <= 0 {
+		logrus.Fatalf("resync-interval must be positive")
+	}
+	if *maxEndpointRemovals < 0 {
+		logrus.Fatalf("max-endpoint-removals must not be negative")
+	}
+	if *maxTargetRemovalPercent < 0 || *maxTargetRemovalPercent > 100 {
+		logrus.Fatalf("max-target-removal-percent must be between 0 and 100")
+	}
+	guard = newRemovalGuard(*maxEndpointRemovals, *maxTargetRemovalPercent)
+	if *leaseDuration < 3*time.Second {
+		logrus.Fatalf("leader-lease-duration must be at least 3s")
+	}
+
 	// initialize metadata client
 	var err error
 	m, err = metadata.NewMetadataClient(*metadataAddress)
 	if err != nil {
 		logrus.Fatalf("Failed to initialize Rancher metadata client: %v", err)
 	}
-
-	// initialize cattle client
-	c, err = NewCattleClientFromEnvironment()
+	policy, err := metadata.ParseTargetPolicy(*targetPolicy, metadata.DefaultTargetPolicy)
 	if err != nil {
-		logrus.Fatalf("Failed to initialize Rancher API client: %v", err)
+		logrus.Fatalf("Invalid target-policy: %v", err)
+	}
+	m.TargetPolicy = &policy
+	if m.HostSelector, err = metadata.ParseHostSelector(*hostSelector); err != nil {
+		logrus.Fatalf("Invalid host-selector: %v", err)
 	}
 
-	// initialize provider
-	provider, err = providers.GetProvider(*providerName)
-	if err != nil {
-		logrus.Fatalf("Failed to initialize provider '%s': %v", *providerName, err)
+	// initialize cattle client, which is not needed in dry-run mode and by gc
+	if !*dryRun && flag.Arg(0) != "gc" {
+		c, err = NewCattleClientFromEnvironment()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Rancher API client: %v", err)
+		}
+		conflicts = newConflictReporter(func(service model.ServiceRef, note string) error {
+			return c.SetServiceNote(service.Name, service.Stack, note)
+		})
+	}
+
+	// initialize providers
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(*providerNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			logrus.Fatalf("Invalid provider list '%s'", *providerNames)
+		}
+		seen[name] = true
+
+		provider, err := providers.GetProvider(name)
+		if err != nil {
+			logrus.Fatalf("Failed to initialize provider '%s': %v", name, err)
+		}
+		p := newLBProvider(name, provider)
+		logrus.Infof("Updating up to %d endpoints concurrently on provider %s", p.concurrency, name)
+		if !p.caps.FQDN {
+			logrus.Infof("Provider %s does not report endpoint FQDNs, service FQDNs in Rancher are not updated", name)
+		}
+		lbProviders = append(lbProviders, p)
 	}
 
 	targetPoolSuffix = os.Getenv("LB_TARGET_RANCHER_SUFFIX")
@@ -79,6 +162,11 @@ func setEnv() {
 		logrus.Info("LB_TARGET_RANCHER_SUFFIX is not set, using default suffix 'rancher.internal'")
 		targetPoolSuffix = "rancher.internal"
 	}
+	m.InstanceID = *instanceID
+	if m.InstanceID == "" {
+		m.InstanceID = targetPoolSuffix
+	}
+	apiToken = os.Getenv("EXTERNAL_LB_API_TOKEN")
 
 }
 
@@ -86,68 +174,154 @@ func main() {
 	logrus.Infof("Starting Rancher External LoadBalancer service")
 	setEnv()
 
-	go startHealthcheck()
+	switch flag.Arg(0) {
+	case "plan":
+		if err := printPlan(); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	case "gc":
+		if err := runGC(os.Stdout, *gcApply); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
 
-	version := "init"
-	lastUpdated := time.Now()
+	go startHealthcheck()
 
-	ticker := time.NewTicker(time.Duration(pollInterval) * time.Millisecond)
-	defer ticker.Stop()
+	scheduler = NewScheduler(*debounce, *debounceMaxDelay)
+	retries = NewRetryQueue(*retryBaseDelay, *retryMaxDelay)
+	retries.onReady = func() {
+		scheduler.Trigger("retry", true)
+	}
+	drains = newDrainTracker(*drainTimeout)
+	drains.onExpired = func() {
+		scheduler.Trigger("drain", true)
+	}
+	stop := make(chan struct{})
+	go scheduler.WatchMetadata(m.MetadataClient, *metadataPollInterval)
+	go scheduler.Resync(*resyncInterval, *resyncJitter, stop)
+	go triggerOnSignal(scheduler)
 
-	for range ticker.C {
-		update, updateForced := false, false
-		newVersion, err := m.GetVersion()
+	if *leaderElect != "" {
+		lock, err := newLeaderLock(*leaderElect)
 		if err != nil {
-			logrus.Errorf("Failed to get metadata version: %v", err)
-		} else if version != newVersion {
-			logrus.Debugf("Metadata version changed. Old: %s New: %s.", version, newVersion)
-			version = newVersion
-			update = true
-		} else {
-			if time.Since(lastUpdated).Minutes() >= forceUpdateInterval {
-				logrus.Debugf("Executing force update as metadata version hasn't changed in: %d minutes",
-					forceUpdateInterval)
-				updateForced = true
-			}
+			logrus.Fatal(err)
 		}
+		elector = leader.NewElector(lock, replicaID(), *leaseDuration, onLeaderChange)
+		logrus.Infof("Leader election enabled, replica %s is on standby until it acquires the lease", elector.ID())
+		go elector.Run()
+		go releaseOnSignal(elector)
+	}
 
-		if update || updateForced {
-			// get records from metadata
-			metadataLBConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
-			if err != nil {
-				logrus.Errorf("Failed to get LB configs from metadata: %v", err)
+	scheduler.Trigger("startup", true)
+	scheduler.Run(reconcile, stop)
+}
+
+// reconcile updates the provider with the LB configs from metadata.
+// Unless forced, nothing is done if the configs did not change since
+// the last run.
+func reconcile(force bool) {
+	if !isLeader() {
+		logrus.Debugf("Not the leader, skipping update")
+		return
+	}
+
+	// get records from metadata
+	metadataLBConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		metadataFailures.Inc()
+		logrus.Errorf("Failed to get LB configs from metadata: %v", err)
+		return
+	}
+
+	logrus.Debugf("LB configs from metadata: %v", metadataLBConfigs)
+	if conflicts != nil {
+		conflicts.Report(m.Conflicts())
+	}
+
+	// A flapping service might cause the metadata version to change
+	// in short intervals. Caching the previous LB Configs allows
+	// us to check if the actual LB Configs have changed, so we
+	// don't end up flooding the provider with unnecessary requests.
+	if reflect.DeepEqual(metadataLBConfigs, metadataLBConfigsCached) && !force {
+		logrus.Debugf("LB configs from metadata did not change")
+		return
+	}
+
+	if *dryRun {
+		logPlan(metadataLBConfigs)
+		metadataLBConfigsCached = metadataLBConfigs
+		return
+	}
+
+	// update the provider
+	start := time.Now()
+	updatedFqdn, err := UpdateProviderLBConfigs(metadataLBConfigs)
+	recordReconcile(metadataLBConfigs, start, err)
+	if err == errNotLeader {
+		logrus.Warnf("Aborted update of the provider: %v", err)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to update provider: %v", err)
+	}
+
+	// update the service FQDN in Cattle
+	for fqdn, config := range updatedFqdn {
+		services := config.Services
+		if len(services) == 0 {
+			name, err := model.ParsePoolName(config.LBTargetPoolName, targetPoolSuffix)
+			if err != nil || name.Endpoint != "" {
+				logrus.Errorf("Failed to update FQDN of endpoint %s: cannot find its service from pool name %s: %v",
+					config.LBEndpoint, config.LBTargetPoolName, err)
 				continue
 			}
-
-			logrus.Debugf("LB configs from metadata: %v", metadataLBConfigs)
-
-			// A flapping service might cause the metadata version to change
-			// in short intervals. Caching the previous LB Configs allows
-			// us to check if the actual LB Configs have changed, so we
-			// don't end up flooding the provider with unnecessary requests.
-			if !reflect.DeepEqual(metadataLBConfigs, metadataLBConfigsCached) || updateForced {
-				// update the provider
-				updatedFqdn, err := UpdateProviderLBConfigs(metadataLBConfigs)
-				if err != nil {
-					logrus.Errorf("Failed to update provider: %v", err)
-				}
-
-				// update the service FQDN in Cattle
-				for fqdn, config := range updatedFqdn {
-					// service_stack_environment_suffix
-					parts := strings.Split(config.LBTargetPoolName, "_")
-					err := c.UpdateServiceFqdn(parts[0], parts[1], fqdn)
-					if err != nil {
-						logrus.Errorf("Failed to update service FQDN: %v", err)
-					}
-				}
-
-				metadataLBConfigsCached = metadataLBConfigs
-				lastUpdated = time.Now()
-
-			} else {
-				logrus.Debugf("LB configs from metadata did not change")
+			services = []model.ServiceRef{name.Service}
+		}
+		for _, service := range services {
+			err := c.UpdateServiceFqdn(service.Name, service.Stack, fqdn)
+			if err != nil {
+				logrus.Errorf("Failed to update service FQDN: %v", err)
 			}
 		}
 	}
+
+	metadataLBConfigsCached = metadataLBConfigs
+}
+
+// triggerOnSignal triggers a forced reconcile on SIGHUP.
+func triggerOnSignal(s *Scheduler) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logrus.Info("Received SIGHUP, triggering reconcile")
+		s.Trigger("signal", true)
+	}
+}
+
+// printPlan prints the changes that would be made to the provider to stdout.
+func printPlan() error {
+	metadataLBConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		return fmt.Errorf("Failed to get LB configs from metadata: %v", err)
+	}
+
+	plans, err := PlanProviderLBConfigs(metadataLBConfigs)
+	printPlans(os.Stdout, plans)
+	return err
+}
+
+func logPlan(metadataLBConfigs map[string]model.LBConfig) {
+	plans, err := PlanProviderLBConfigs(metadataLBConfigs)
+	if err != nil {
+		logrus.Errorf("Failed to plan provider update: %v", err)
+		if len(plans) == 0 {
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	printPlans(&buf, plans)
+	logrus.Infof("Dry run, not applying changes to provider:\n%s", buf.String())
 }
@@ -0,0 +1,84 @@
+package metadata
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// Conflict describes a service that cannot use an endpoint
+// because another service with precedence uses it.
+type Conflict struct {
+	Endpoint string           `json:"endpoint"`
+	Service  model.ServiceRef `json:"service"`
+	Winner   model.ServiceRef `json:"winner"`
+	Reason   string           `json:"reason"`
+}
+
+// sortServices sorts the services in the order in which they claim
+// endpoints: by the priority label, highest first, then by create index,
+// oldest first. Services are never reordered between polls, so the service
+// using a contested endpoint does not flip.
+func sortServices(services []metadata.Service) []metadata.Service {
+	sorted := make([]metadata.Service, len(services))
+	copy(sorted, services)
+	priorities := make(map[string]int, len(sorted))
+	for _, service := range sorted {
+		priorities[serviceKey(service)] = servicePriority(service)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if pa, pb := priorities[serviceKey(a)], priorities[serviceKey(b)]; pa != pb {
+			return pa > pb
+		}
+		if a.CreateIndex != b.CreateIndex {
+			return a.CreateIndex < b.CreateIndex
+		}
+		return serviceKey(a) < serviceKey(b)
+	})
+	return sorted
+}
+
+func serviceKey(service metadata.Service) string {
+	return service.StackName + "/" + service.Name
+}
+
+// servicePriority returns the value of the priority label of the
+// service, or 0 if it is not set.
+func servicePriority(service metadata.Service) int {
+	value, ok := service.Labels[serviceLabelPriority]
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		logrus.Warnf("Ignoring priority '%s' of service %s: not an integer", value, service.Name)
+		return 0
+	}
+	return priority
+}
+
+// Conflicts returns the conflicts found by the last call to
+// GetMetadataLBConfigs, sorted by endpoint and service.
+func (m *MetadataClient) Conflicts() []Conflict {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conflicts := make([]Conflict, len(m.conflicts))
+	copy(conflicts, m.conflicts)
+	return conflicts
+}
+
+func (m *MetadataClient) setConflicts(conflicts []Conflict) {
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Endpoint != conflicts[j].Endpoint {
+			return conflicts[i].Endpoint < conflicts[j].Endpoint
+		}
+		return conflicts[i].Service.String() < conflicts[j].Service.String()
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conflicts = conflicts
+}
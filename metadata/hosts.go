@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// hostRequirement is a single term of a host selector.
+type hostRequirement struct {
+	key   string
+	value string
+	// op is one of "=", "!=", "exists" and "!exists"
+	op string
+}
+
+func (r hostRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.op {
+	case "=":
+		return ok && value == r.value
+	case "!=":
+		return !ok || value != r.value
+	case "exists":
+		return ok
+	default:
+		return !ok
+	}
+}
+
+// HostSelector selects hosts by their labels. The zero
+// value selects all hosts.
+type HostSelector struct {
+	requirements []hostRequirement
+}
+
+// ParseHostSelector parses a comma separated list of host label
+// requirements, all of which a host has to meet: "key=value",
+// "key!=value", "key" for hosts having the label and "!key" for
+// hosts not having it, e.g. "lb-zone=dmz,maintenance!=true".
+func ParseHostSelector(spec string) (HostSelector, error) {
+	var selector HostSelector
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r hostRequirement
+		if i := strings.Index(term, "!="); i >= 0 {
+			r = hostRequirement{key: term[:i], value: term[i+2:], op: "!="}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			r = hostRequirement{key: term[:i], value: term[i+1:], op: "="}
+		} else if strings.HasPrefix(term, "!") {
+			r = hostRequirement{key: term[1:], op: "!exists"}
+		} else {
+			r = hostRequirement{key: term, op: "exists"}
+		}
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if r.key == "" {
+			return HostSelector{}, fmt.Errorf("Invalid host selector term '%s'", term)
+		}
+		selector.requirements = append(selector.requirements, r)
+	}
+	return selector, nil
+}
+
+// Empty returns true if the selector selects all hosts.
+func (s HostSelector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+// Matches returns true if a host with the labels is selected.
+func (s HostSelector) Matches(labels map[string]string) bool {
+	for _, r := range s.requirements {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceHostSelector returns the host selector of the service: the
+// global selector together with the one of the service's label, if any.
+func (m *MetadataClient) serviceHostSelector(service metadata.Service) (HostSelector, error) {
+	spec, ok := service.Labels[serviceLabelHostSelector]
+	if !ok {
+		return m.HostSelector, nil
+	}
+	selector, err := ParseHostSelector(spec)
+	if err != nil {
+		return HostSelector{}, err
+	}
+	selector.requirements = append(append([]hostRequirement(nil), m.HostSelector.requirements...),
+		selector.requirements...)
+	return selector, nil
+}
+
+// selectHosts returns the service with only the containers running on
+// hosts selected by the selector.
+func selectHosts(service metadata.Service, hosts map[string]metadata.Host, selector HostSelector) metadata.Service {
+	if selector.Empty() {
+		return service
+	}
+	var containers []metadata.Container
+	for _, container := range service.Containers {
+		host, ok := hosts[container.HostUUID]
+		if !ok {
+			logrus.Debugf("Skipping container %s on unknown host %s", container.Name, container.HostUUID)
+			continue
+		}
+		if !selector.Matches(host.Labels) {
+			logrus.Debugf("Skipping container %s on host %s, which is not selected", container.Name, host.Name)
+			continue
+		}
+		containers = append(containers, container)
+	}
+	service.Containers = containers
+	return service
+}
+
+// hostAgentIP returns the agent IP of the host, for ports published
+// on all addresses of the host.
+func hostAgentIP(host metadata.Host) (net.IP, error) {
+	ip := net.ParseIP(host.AgentIP)
+	if ip == nil {
+		return nil, fmt.Errorf("host %s has no valid agent IP '%s'", host.Name, host.AgentIP)
+	}
+	return ip, nil
+}
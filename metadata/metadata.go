@@ -5,7 +5,10 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/external-lb/model"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,6 +16,14 @@ const (
 	metadataURLTemplate        = "http://%v/2015-12-19"
 	serviceLabelEndpoint       = "io.rancher.service.external_lb.endpoint"
 	serviceLabelEndpointLegacy = "io.rancher.service.external_lb_endpoint"
+	serviceLabelProvider       = "io.rancher.service.external_lb.provider"
+	// the weight label can be set on containers, hosts and services
+	labelWeight               = "io.rancher.service.external_lb.weight"
+	serviceLabelTrafficWeight = "io.rancher.service.external_lb.traffic_weight"
+	serviceLabelTargetMode    = "io.rancher.service.external_lb.target_mode"
+	serviceLabelTargetPolicy  = "io.rancher.service.external_lb.target_policy"
+	serviceLabelHostSelector  = "io.rancher.service.external_lb.host_selector"
+	serviceLabelPriority      = "io.rancher.service.external_lb.priority"
 
 	// DefaultMetadataAddress specifies the default value to use if nothing is specified
 	DefaultMetadataAddress = "169.254.169.250"
@@ -22,6 +33,22 @@ const (
 type MetadataClient struct {
 	MetadataClient  metadata.Client
 	EnvironmentUUID string
+	// TargetPolicy is the target policy of services without a policy
+	// label. DefaultTargetPolicy is used if it is nil.
+	TargetPolicy *TargetPolicy
+	// HostSelector selects the hosts whose containers are targets
+	// of all services.
+	HostSelector HostSelector
+	// InstanceID identifies this external-lb instance in the owner
+	// records of the configs.
+	InstanceID string
+
+	mu sync.Mutex
+	// initializing maps the UUIDs of initializing containers
+	// to the time they were first seen initializing
+	initializing map[string]time.Time
+	clock        func() time.Time
+	conflicts    []Conflict
 }
 
 func getEnvironmentUUID(m metadata.Client) (string, error) {
@@ -69,129 +96,365 @@ func (m *MetadataClient) GetVersion() (string, error) {
 	return m.MetadataClient.GetVersion()
 }
 
-// GetMetadataLBConfigs ...
+// GetMetadataLBConfigs returns the LB configs of the services with an
+// endpoint label, keyed by endpoint. If several services use an endpoint,
+// the service with the highest priority label, or else the oldest one,
+// gets it, unless they split its traffic. The other services are reported
+// by Conflicts.
 func (m *MetadataClient) GetMetadataLBConfigs(targetPoolSuffix string) (map[string]model.LBConfig, error) {
 	lbConfigs := make(map[string]model.LBConfig)
+	// services sharing an endpoint by traffic weight, merged at the end
+	splits := make(map[string][]splitPart)
+	// the service that got each endpoint first
+	owners := make(map[string]model.ServiceRef)
+	var conflicts []Conflict
+	hosts, err := m.getHostsByUUID()
+	if err != nil {
+		return nil, err
+	}
 	services, err := m.MetadataClient.GetServices()
 	if err != nil {
-		logrus.Infof("Error reading services: %v", err)
+		return nil, fmt.Errorf("Error reading services: %v", err)
 	} else {
-		for _, service := range services {
-			endpoint, ok := service.Labels[serviceLabelEndpoint]
+		for _, service := range sortServices(services) {
+			label, ok := service.Labels[serviceLabelEndpoint]
 			if !ok {
-				endpoint, ok = service.Labels[serviceLabelEndpointLegacy]
+				label, ok = service.Labels[serviceLabelEndpointLegacy]
 			}
 			if !ok {
 				continue
 			}
 
 			logrus.Debugf("LB label exists for service : %v", service.Name)
-			// Configure this service only if this endpoint is already not used by some other service so far
-			_, ok = lbConfigs[endpoint]
-			if ok {
-				logrus.Errorf("Endpoint %s already used by another service, will skip this service : %s",
-					endpoint, service.Name)
+			mode, err := targetMode(service)
+			if err != nil {
+				logrus.Warnf("Skipping LB configuration for service %s: %v", service.Name, err)
 				continue
 			}
-
-			// get the service port
-			if len(service.Ports) == 0 {
-				logrus.Warnf("Skipping LB configuration for service %s: "+
-					"Service hasn't any ports exposed", service.Name)
+			mappings, err := parseEndpointLabel(label, service.Ports, mode == model.TargetModeContainer)
+			if err != nil {
+				logrus.Warnf("Skipping LB configuration for service %s: %v", service.Name, err)
 				continue
 			}
-
-			portspec := strings.Split(service.Ports[0], ":")
-			if len(portspec) != 2 {
-				logrus.Warnf("Skipping LB configuration for service %s: "+
-					"Unexpected format of service port spec: %s",
-					service.Name, service.Ports[0])
+			policy, err := m.servicePolicy(service)
+			if err != nil {
+				logrus.Warnf("Skipping LB configuration for service %s: %v", service.Name, err)
 				continue
 			}
-
-			lbConfig := model.LBConfig{}
-			lbConfig.LBEndpoint = endpoint
-			lbConfig.LBTargetPort = portspec[0]
-			lbConfig.LBTargetPoolName = fmt.Sprintf("%s_%s_%s_%s", service.Name, service.StackName,
-				m.EnvironmentUUID, targetPoolSuffix)
-
-			if err = m.getContainerLBTargets(&lbConfig, service); err != nil {
+			selector, err := m.serviceHostSelector(service)
+			if err != nil {
+				logrus.Warnf("Skipping LB configuration for service %s: %v", service.Name, err)
 				continue
 			}
+			containers := m.targetContainers(selectHosts(service, hosts, selector), policy)
+			weight, split, err := trafficWeight(service)
+			if err != nil {
+				logrus.Warnf("Skipping LB configuration for service %s: %v", service.Name, err)
+				continue
+			}
+
+			ref := model.ServiceRef{Stack: service.StackName, Name: service.Name}
+			for _, mapping := range mappings {
+				// Configure this service only if this endpoint is already not used by some other service so far,
+				// unless all services using it split the traffic by weight
+				_, used := lbConfigs[mapping.endpoint]
+				if _, ok := splits[mapping.endpoint]; ok && !split {
+					used = true
+				}
+				if used {
+					logrus.Errorf("Endpoint %s already used by service %s, will skip this service : %s",
+						mapping.endpoint, owners[mapping.endpoint], service.Name)
+					conflicts = append(conflicts, Conflict{
+						Endpoint: mapping.endpoint,
+						Service:  ref,
+						Winner:   owners[mapping.endpoint],
+						Reason:   "endpoint already used by a service with precedence",
+					})
+					continue
+				}
+
+				lbConfig := model.LBConfig{}
+				lbConfig.LBEndpoint = mapping.endpoint
+				lbConfig.LBTargetPort = mapping.ports[0]
+				lbConfig.Protocol = mapping.protocol
+				lbConfig.TargetMode = mode
+				if len(mapping.ports) > 1 {
+					lbConfig.Ports = mapping.ports
+				}
+				lbConfig.LBTargetPoolName = model.PoolName{
+					Service:     ref,
+					Environment: m.EnvironmentUUID,
+					Suffix:      targetPoolSuffix,
+				}.String()
+				lbConfig.Provider = service.Labels[serviceLabelProvider]
+				lbConfig.Scale = service.Scale
+				lbConfig.Owner = m.owner(service.UUID)
+
+				if mode == model.TargetModeContainer {
+					getContainerIPTargets(&lbConfig, service, containers, hosts)
+				} else {
+					getContainerLBTargets(&lbConfig, service, containers, hosts)
+				}
 
-			lbConfigs[endpoint] = lbConfig
+				if split {
+					part := splitPart{
+						config:  lbConfig,
+						service: ref,
+						weight:  weight,
+					}
+					if err := checkSplitPart(splits[mapping.endpoint], part); err != nil {
+						logrus.Errorf("Skipping LB configuration for service %s: %v", service.Name, err)
+						conflicts = append(conflicts, Conflict{
+							Endpoint: mapping.endpoint,
+							Service:  ref,
+							Winner:   owners[mapping.endpoint],
+							Reason:   err.Error(),
+						})
+						continue
+					}
+					if _, ok := owners[mapping.endpoint]; !ok {
+						owners[mapping.endpoint] = ref
+					}
+					splits[mapping.endpoint] = append(splits[mapping.endpoint], part)
+					continue
+				}
+				owners[mapping.endpoint] = ref
+				lbConfigs[mapping.endpoint] = lbConfig
+			}
 		}
 	}
 
+	m.pruneInitializing(services)
+	m.setConflicts(conflicts)
+
+	for endpoint, parts := range splits {
+		merged := mergeSplit(endpoint, parts, model.PoolName{
+			Endpoint:    endpoint,
+			Environment: m.EnvironmentUUID,
+			Suffix:      targetPoolSuffix,
+		}.String())
+		merged.Owner = m.owner("")
+		lbConfigs[endpoint] = merged
+	}
+
 	return lbConfigs, nil
 }
 
-func (m *MetadataClient) getContainerLBTargets(lbConfig *model.LBConfig, service metadata.Service) error {
-	for _, container := range service.Containers {
-		if len(container.ServiceName) == 0 {
-			continue
+// portMapping maps ports of a service to an LB endpoint.
+type portMapping struct {
+	endpoint string
+	ports    []string
+	protocol string
+}
+
+// parseEndpointLabel parses the value of the endpoint label of a service.
+// The value is either a single endpoint, which is mapped to the first port
+// of the service, or a comma separated list of endpoint:port pairs, e.g.
+// "my-vs:443,my-vs-http:80", mapping published ports to endpoints. A port
+// published for both TCP and UDP is mapped for TCP unless the protocol is
+// given, e.g. "my-dns:53/udp". Ports mapped to the same endpoint are served
+// by a single config and must use the same protocol.
+//
+// If private is set, the ports are the private ports of the containers,
+// which need not be published.
+func parseEndpointLabel(value string, servicePorts []string, private bool) ([]portMapping, error) {
+	if !strings.ContainsAny(value, ":,") {
+		if len(servicePorts) == 0 {
+			if private {
+				return nil, fmt.Errorf("Service hasn't any ports exposed, map the endpoint to a port with endpoint:port")
+			}
+			return nil, fmt.Errorf("Service hasn't any ports exposed")
 		}
+		public, privatePort, protocol, err := parseServicePort(servicePorts[0])
+		if err != nil {
+			return nil, err
+		}
+		port := public
+		if private {
+			port = privatePort
+		}
+		return []portMapping{{endpoint: value, ports: []string{port}, protocol: protocol}}, nil
+	}
 
-		if !containerStateOK(container) {
-			logrus.Debugf("Skipping container %s with state '%s' and health '%s'",
-				container.Name, container.State, container.HealthState)
+	published := make(map[string]bool, len(servicePorts))
+	for _, spec := range servicePorts {
+		public, privatePort, protocol, err := parseServicePort(spec)
+		if err != nil {
+			// only fatal for the port of a single endpoint
 			continue
 		}
+		if private {
+			public = privatePort
+		}
+		published[public+"/"+protocol] = true
+	}
 
-		if len(service.Name) != 0 {
-			if service.Name != container.ServiceName {
-				continue
-			}
-			if service.StackName != container.StackName {
-				continue
+	var mappings []portMapping
+	byEndpoint := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		i := strings.LastIndex(entry, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid endpoint mapping '%s', expected endpoint:port", entry)
+		}
+		endpoint, port := entry[:i], entry[i+1:]
+		protocol := model.ProtocolTCP
+		if j := strings.Index(port, "/"); j >= 0 {
+			port, protocol = port[:j], port[j+1:]
+		} else if !published[port+"/"+protocol] && published[port+"/"+model.ProtocolUDP] {
+			protocol = model.ProtocolUDP
+		}
+		if !published[port+"/"+protocol] && !private {
+			return nil, fmt.Errorf("Endpoint %s is mapped to port %s/%s, which the service does not publish",
+				endpoint, port, protocol)
+		}
+		if n, ok := byEndpoint[endpoint]; ok {
+			if mappings[n].protocol != protocol {
+				return nil, fmt.Errorf("Endpoint %s is mapped to both %s and %s ports",
+					endpoint, mappings[n].protocol, protocol)
 			}
+			mappings[n].ports = append(mappings[n].ports, port)
+			continue
 		}
+		byEndpoint[endpoint] = len(mappings)
+		mappings = append(mappings, portMapping{endpoint: endpoint, ports: []string{port}, protocol: protocol})
+	}
+	return mappings, nil
+}
+
+// parseServicePort returns the published port, the private port and the
+// protocol of a service port spec, e.g. "5353:53/udp".
+func parseServicePort(spec string) (public, private, protocol string, err error) {
+	portspec := strings.Split(spec, ":")
+	if len(portspec) != 2 {
+		return "", "", "", fmt.Errorf("Unexpected format of service port spec: %s", spec)
+	}
+	private = portspec[1]
+	if i := strings.Index(private, "/"); i >= 0 {
+		private = private[:i]
+	}
+	return portspec[0], private, portProtocol(portspec[1]), nil
+}
+
+// parseContainerPort returns the host IP, the published port and the
+// protocol of a container port spec, e.g. "10.0.0.1:53:53/udp". IPv6
+// addresses may be enclosed in brackets, e.g. "[fd00::1]:53:53/udp".
+func parseContainerPort(spec string) (ip net.IP, port, protocol string, err error) {
+	// the ports are the last two fields, as an IPv6 address contains colons
+	portspec := strings.Split(spec, ":")
+	n := len(portspec)
+	if n < 3 {
+		return nil, "", "", fmt.Errorf("Unexpected format of port spec: %s", spec)
+	}
+	host := strings.Join(portspec[:n-2], ":")
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if ip = net.ParseIP(host); ip == nil {
+		return nil, "", "", fmt.Errorf("Invalid IP address '%s' in port spec: %s", host, spec)
+	}
+	if _, err := strconv.Atoi(portspec[n-2]); err != nil {
+		return nil, "", "", fmt.Errorf("Invalid port '%s' in port spec: %s", portspec[n-2], spec)
+	}
+	return ip, portspec[n-2], portProtocol(portspec[n-1]), nil
+}
+
+// portProtocol returns the protocol of a private port spec, e.g. "53/udp".
+// Ports without protocol are TCP.
+func portProtocol(private string) string {
+	if i := strings.Index(private, "/"); i >= 0 && private[i+1:] != "" {
+		return strings.ToLower(private[i+1:])
+	}
+	return model.ProtocolTCP
+}
+
+// owner returns the owner record of the configs of the service with the
+// UUID, or of a config shared by several services if the UUID is empty.
+func (m *MetadataClient) owner(serviceUUID string) *model.Owner {
+	return &model.Owner{
+		Environment: m.EnvironmentUUID,
+		Service:     serviceUUID,
+		Instance:    m.InstanceID,
+		Version:     model.OwnerVersion,
+	}
+}
+
+func (m *MetadataClient) getHostsByUUID() (map[string]metadata.Host, error) {
+	hosts, err := m.MetadataClient.GetHosts()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading hosts: %v", err)
+	}
+	byUUID := make(map[string]metadata.Host, len(hosts))
+	for _, host := range hosts {
+		byUUID[host.UUID] = host
+	}
+	return byUUID, nil
+}
 
+// getContainerLBTargets adds the ports published by the containers on
+// their host as targets. Malformed ports are skipped.
+func getContainerLBTargets(lbConfig *model.LBConfig, service metadata.Service,
+	containers []metadata.Container, hosts map[string]metadata.Host) {
+	for _, container := range containers {
 		if len(container.Ports) == 0 {
 			continue
 		}
 
-		for _, port := range container.Ports {
+		for _, spec := range container.Ports {
 			// split the container port to get the publicip:port
-			portspec := strings.Split(port, ":")
-			if len(portspec) != 3 {
-				logrus.Warnf("Unexpected format of port spec for container %s: %s", container.Name, port)
+			ip, port, protocol, err := parseContainerPort(spec)
+			if err != nil {
+				logrus.Warnf("Skipping port of container %s: %v", container.Name, err)
 				continue
 			}
 
-			ip := portspec[0]
-			port := portspec[1]
-			if port != lbConfig.LBTargetPort {
-				logrus.Debugf("Container portspec '%s' does not match LBTargetPort %s", portspec, lbConfig.LBTargetPort)
+			if !lbConfig.HasPort(port) || protocol != lbConfig.Protocol {
+				logrus.Debugf("Container portspec '%s' does not match LBTargetPort %s/%s",
+					spec, lbConfig.LBTargetPort, lbConfig.Protocol)
 				continue
 			}
 
-			lbTarget := model.LBTarget{
-				HostIP: ip,
-				Port:   port,
+			if ip.IsUnspecified() {
+				// published on all addresses, use the address of the host
+				if ip, err = hostAgentIP(hosts[container.HostUUID]); err != nil {
+					logrus.Warnf("Skipping port of container %s: %v", container.Name, err)
+					continue
+				}
 			}
+
+			lbTarget := model.NewLBTarget(ip, port)
+			lbTarget.Protocol = protocol
+			lbTarget.Weight = targetWeight(container, hosts[container.HostUUID], service)
 			lbConfig.LBTargets = append(lbConfig.LBTargets, lbTarget)
 		}
 	}
 
 	logrus.Debugf("Found %d target IPs for service %s", len(lbConfig.LBTargets), service.Name)
-	return nil
 }
 
-func containerStateOK(container metadata.Container) bool {
-	switch container.State {
-	case "running":
-	default:
-		return false
+// targetWeight returns the weight set by the label of the container,
+// of its host or of its service, in that order, or 0 if none is set.
+func targetWeight(container metadata.Container, host metadata.Host, service metadata.Service) int {
+	sources := []struct {
+		kind, name string
+		labels     map[string]string
+	}{
+		{"container", container.Name, container.Labels},
+		{"host", host.Hostname, host.Labels},
+		{"service", service.Name, service.Labels},
 	}
-
-	switch container.HealthState {
-	case "healthy":
-	case "updating-healthy":
-	case "":
-	default:
-		return false
+	for _, source := range sources {
+		value, ok := source.labels[labelWeight]
+		if !ok {
+			continue
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 {
+			logrus.Warnf("Ignoring weight label of %s %s: '%s' is not a positive integer",
+				source.kind, source.name, value)
+			continue
+		}
+		return weight
 	}
-
-	return true
+	return 0
 }
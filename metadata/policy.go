@@ -0,0 +1,203 @@
+package metadata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	// healthNone stands for the empty health state
+	// of containers without a health check
+	healthNone         = "none"
+	healthInitializing = "initializing"
+)
+
+// TargetPolicy decides which containers of a service are targets.
+type TargetPolicy struct {
+	// States are the container states that qualify.
+	States []string
+	// HealthStates are the health states that qualify, with "none"
+	// standing for containers without a health check.
+	HealthStates []string
+	// InitializingGrace is how long an initializing container counts as
+	// healthy, from the time it is first seen initializing. 0 disables it.
+	InitializingGrace time.Duration
+	// KeepUnhealthy makes the containers in a qualifying state but not
+	// health state targets if the service has no other targets, rather
+	// than leaving the pool empty.
+	KeepUnhealthy bool
+}
+
+// DefaultTargetPolicy makes running containers targets
+// if they are healthy or have no health check.
+var DefaultTargetPolicy = TargetPolicy{
+	States:       []string{"running"},
+	HealthStates: []string{"healthy", "updating-healthy", healthNone},
+}
+
+// ParseTargetPolicy parses a policy spec of semicolon separated options,
+// e.g. "states=running,updating-running;health=healthy,none;
+// initializing-grace=60s;keep-unhealthy=true". Options missing from the
+// spec are taken from base.
+func ParseTargetPolicy(spec string, base TargetPolicy) (TargetPolicy, error) {
+	policy := base
+	for _, option := range strings.Split(spec, ";") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return base, fmt.Errorf("Invalid target policy option '%s', expected key=value", option)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "states":
+			policy.States = splitList(value)
+		case "health":
+			policy.HealthStates = splitList(value)
+		case "initializing-grace":
+			grace, err := time.ParseDuration(value)
+			if err != nil || grace < 0 {
+				return base, fmt.Errorf("Invalid initializing-grace '%s'", value)
+			}
+			policy.InitializingGrace = grace
+		case "keep-unhealthy":
+			keep, err := strconv.ParseBool(value)
+			if err != nil {
+				return base, fmt.Errorf("Invalid keep-unhealthy '%s'", value)
+			}
+			policy.KeepUnhealthy = keep
+		default:
+			return base, fmt.Errorf("Unknown target policy option '%s'", key)
+		}
+	}
+	if len(policy.States) == 0 {
+		return base, fmt.Errorf("Target policy '%s' has no container states", spec)
+	}
+	return policy, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// servicePolicy returns the target policy of the service: the global
+// policy with the options of the service's policy label, if any.
+func (m *MetadataClient) servicePolicy(service metadata.Service) (TargetPolicy, error) {
+	policy := DefaultTargetPolicy
+	if m.TargetPolicy != nil {
+		policy = *m.TargetPolicy
+	}
+	if spec, ok := service.Labels[serviceLabelTargetPolicy]; ok {
+		return ParseTargetPolicy(spec, policy)
+	}
+	return policy, nil
+}
+
+// targetContainers returns the containers of the service that are targets
+// under the policy.
+func (m *MetadataClient) targetContainers(service metadata.Service, policy TargetPolicy) []metadata.Container {
+	var targets, unhealthy []metadata.Container
+	for _, container := range service.Containers {
+		if len(container.ServiceName) == 0 {
+			continue
+		}
+		if service.Name != container.ServiceName || service.StackName != container.StackName {
+			continue
+		}
+		if !hasState(policy.States, container.State) {
+			logrus.Debugf("Skipping container %s with state '%s'", container.Name, container.State)
+			continue
+		}
+		if !m.healthOK(container, policy) {
+			logrus.Debugf("Skipping container %s with health '%s'", container.Name, container.HealthState)
+			unhealthy = append(unhealthy, container)
+			continue
+		}
+		targets = append(targets, container)
+	}
+
+	if len(targets) == 0 && len(unhealthy) > 0 && policy.KeepUnhealthy {
+		logrus.Warnf("Service %s has no healthy containers, keeping %d unhealthy containers as targets",
+			service.Name, len(unhealthy))
+		return unhealthy
+	}
+	return targets
+}
+
+// healthOK returns true if the health state of the container qualifies.
+func (m *MetadataClient) healthOK(container metadata.Container, policy TargetPolicy) bool {
+	health := container.HealthState
+	if health == "" {
+		health = healthNone
+	}
+	if hasState(policy.HealthStates, health) {
+		return true
+	}
+	if health != healthInitializing || policy.InitializingGrace <= 0 {
+		return false
+	}
+	return m.initializingFor(container) < policy.InitializingGrace
+}
+
+// initializingFor returns how long the container has been seen initializing.
+func (m *MetadataClient) initializingFor(container metadata.Container) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.initializing == nil {
+		m.initializing = make(map[string]time.Time)
+	}
+	now := time.Now()
+	if m.clock != nil {
+		now = m.clock()
+	}
+	since, ok := m.initializing[container.UUID]
+	if !ok {
+		since = now
+		m.initializing[container.UUID] = now
+	}
+	return now.Sub(since)
+}
+
+// pruneInitializing forgets the containers that are no longer initializing.
+func (m *MetadataClient) pruneInitializing(services []metadata.Service) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.initializing) == 0 {
+		return
+	}
+	current := make(map[string]bool)
+	for _, service := range services {
+		for _, container := range service.Containers {
+			if container.HealthState == healthInitializing {
+				current[container.UUID] = true
+			}
+		}
+	}
+	for uuid := range m.initializing {
+		if !current[uuid] {
+			delete(m.initializing, uuid)
+		}
+	}
+}
+
+func hasState(states []string, state string) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
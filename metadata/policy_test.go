@@ -0,0 +1,84 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestParseTargetPolicy(t *testing.T) {
+	policy, err := ParseTargetPolicy("states=running, updating-running; initializing-grace=1m", DefaultTargetPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TargetPolicy{
+		States:            []string{"running", "updating-running"},
+		HealthStates:      DefaultTargetPolicy.HealthStates,
+		InitializingGrace: time.Minute,
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("policy = %+v, want %+v", policy, want)
+	}
+
+	for _, spec := range []string{"states=", "health", "keep-unhealthy=maybe", "initializing-grace=-1s", "mode=fast"} {
+		if _, err := ParseTargetPolicy(spec, DefaultTargetPolicy); err == nil {
+			t.Errorf("invalid spec '%s' was accepted", spec)
+		}
+	}
+}
+
+func TestTargetContainers(t *testing.T) {
+	container := func(uuid, state, health string) metadata.Container {
+		return metadata.Container{Name: uuid, UUID: uuid, ServiceName: "web", StackName: "app",
+			State: state, HealthState: health}
+	}
+	service := metadata.Service{Name: "web", StackName: "app", Containers: []metadata.Container{
+		container("healthy", "running", "healthy"),
+		container("unchecked", "running", ""),
+		container("starting", "running", "initializing"),
+		container("stopped", "stopped", ""),
+	}}
+	names := func(containers []metadata.Container) []string {
+		var names []string
+		for _, c := range containers {
+			names = append(names, c.Name)
+		}
+		return names
+	}
+
+	now := time.Unix(1000, 0)
+	m := &MetadataClient{clock: func() time.Time { return now }}
+	if got, want := names(m.targetContainers(service, DefaultTargetPolicy)), []string{"healthy", "unchecked"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("default policy: containers = %v, want %v", got, want)
+	}
+
+	grace := DefaultTargetPolicy
+	grace.InitializingGrace = time.Minute
+	if got, want := names(m.targetContainers(service, grace)), []string{"healthy", "unchecked", "starting"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("initializing grace: containers = %v, want %v", got, want)
+	}
+	now = now.Add(time.Minute)
+	if got, want := names(m.targetContainers(service, grace)), []string{"healthy", "unchecked"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("initializing grace expired: containers = %v, want %v", got, want)
+	}
+
+	// the grace period restarts for a container initializing again
+	m.pruneInitializing(nil)
+	if got := names(m.targetContainers(service, grace)); len(got) != 3 {
+		t.Errorf("initializing again: containers = %v, want 3", got)
+	}
+
+	service.Containers[0].HealthState = "unhealthy"
+	service.Containers[1].HealthState = "unhealthy"
+	keep := DefaultTargetPolicy
+	keep.HealthStates = []string{"healthy"}
+	if got := names(m.targetContainers(service, keep)); len(got) != 0 {
+		t.Errorf("without keep-unhealthy: containers = %v, want none", got)
+	}
+	keep.KeepUnhealthy = true
+	if got, want := names(m.targetContainers(service, keep)), []string{"healthy", "unchecked", "starting"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keep-unhealthy: containers = %v, want %v", got, want)
+	}
+}
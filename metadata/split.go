@@ -0,0 +1,121 @@
+package metadata
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// maxSplitWeight is the weight of the targets with the largest
+// share of traffic in a merged config.
+const maxSplitWeight = 100
+
+// splitPart is the config of one of the services sharing an endpoint.
+type splitPart struct {
+	config  model.LBConfig
+	service model.ServiceRef
+	// share of the traffic of the endpoint relative to the other parts
+	weight int
+}
+
+// trafficWeight returns the value of the traffic weight label of the
+// service, and whether it is set.
+func trafficWeight(service metadata.Service) (int, bool, error) {
+	value, ok := service.Labels[serviceLabelTrafficWeight]
+	if !ok {
+		return 0, false, nil
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 0 {
+		return 0, false, fmt.Errorf("Traffic weight '%s' is not a non-negative integer", value)
+	}
+	return weight, true, nil
+}
+
+// checkSplitPart returns an error if the part cannot share
+// the endpoint with the parts already found.
+func checkSplitPart(parts []splitPart, part splitPart) error {
+	if len(parts) == 0 {
+		return nil
+	}
+	if first := parts[0].config; first.Provider != part.config.Provider {
+		return fmt.Errorf("Endpoint %s is shared with service %s, which uses provider '%s' instead of '%s'",
+			first.LBEndpoint, parts[0].service, first.Provider, part.config.Provider)
+	}
+	if first := parts[0].config; first.TargetMode != part.config.TargetMode {
+		return fmt.Errorf("Endpoint %s is shared with service %s, which uses target mode '%s' instead of '%s'",
+			first.LBEndpoint, parts[0].service, targetModeName(first.TargetMode), targetModeName(part.config.TargetMode))
+	}
+	if first := parts[0].config; first.Protocol != part.config.Protocol {
+		return fmt.Errorf("Endpoint %s is shared with service %s, which uses %s instead of %s",
+			first.LBEndpoint, parts[0].service, first.Protocol, part.config.Protocol)
+	}
+	return nil
+}
+
+// mergeSplit merges the configs of the services sharing an endpoint into
+// a single config with the specified pool name. The weights of the targets
+// are set so that each service gets its share of the traffic, spread over
+// its targets by their own weights. Services with a traffic weight of 0
+// get no targets.
+func mergeSplit(endpoint string, parts []splitPart, poolName string) model.LBConfig {
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].service.String() < parts[j].service.String()
+	})
+
+	merged := model.LBConfig{
+		LBEndpoint:       endpoint,
+		LBTargetPoolName: poolName,
+		LBTargetPort:     parts[0].config.LBTargetPort,
+		Protocol:         parts[0].config.Protocol,
+		TargetMode:       parts[0].config.TargetMode,
+		Provider:         parts[0].config.Provider,
+	}
+
+	// share of the traffic of each target, in the order of the parts
+	var shares []float64
+	var targets []model.LBTarget
+	var maxShare float64
+	for _, part := range parts {
+		merged.Services = append(merged.Services, part.service)
+		for _, port := range part.config.TargetPorts() {
+			if !merged.HasPort(port) {
+				merged.Ports = append(merged.TargetPorts(), port)
+			}
+		}
+		if part.weight == 0 {
+			continue
+		}
+		// the pool may only be emptied if all services getting
+		// traffic are scaled to 0
+		merged.Scale += part.config.Scale
+
+		total := 0
+		for _, target := range part.config.LBTargets {
+			total += relativeWeight(target)
+		}
+		for _, target := range part.config.LBTargets {
+			share := float64(part.weight) * float64(relativeWeight(target)) / float64(total)
+			shares = append(shares, share)
+			targets = append(targets, target)
+			maxShare = math.Max(maxShare, share)
+		}
+	}
+
+	for i, target := range targets {
+		target.Weight = int(math.Max(1, math.Floor(maxSplitWeight*shares[i]/maxShare+0.5)))
+		merged.LBTargets = append(merged.LBTargets, target)
+	}
+	return merged
+}
+
+func relativeWeight(target model.LBTarget) int {
+	if target.Weight == 0 {
+		return 1
+	}
+	return target.Weight
+}
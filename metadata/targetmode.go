@@ -0,0 +1,62 @@
+package metadata
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// values of the target mode label
+const (
+	targetModeHost      = "host"
+	targetModeContainer = "container"
+)
+
+// targetMode returns the target mode of the configs of the service:
+// model.TargetModeContainer if its containers are the targets, or an
+// empty string if their hosts are.
+func targetMode(service metadata.Service) (string, error) {
+	switch value := service.Labels[serviceLabelTargetMode]; value {
+	case "", targetModeHost:
+		return "", nil
+	case targetModeContainer:
+		return model.TargetModeContainer, nil
+	default:
+		return "", fmt.Errorf("Unknown target mode '%s', expected '%s' or '%s'",
+			value, targetModeHost, targetModeContainer)
+	}
+}
+
+// targetModeName returns the label value of the target mode of a config.
+func targetModeName(mode string) string {
+	if mode == "" {
+		return targetModeHost
+	}
+	return mode
+}
+
+// getContainerIPTargets adds a target for each port of the config to the
+// config for each of the target containers of the service, addressing the
+// container by its primary IP.
+func getContainerIPTargets(lbConfig *model.LBConfig, service metadata.Service,
+	containers []metadata.Container, hosts map[string]metadata.Host) {
+	for _, container := range containers {
+		ip := net.ParseIP(container.PrimaryIp)
+		if ip == nil {
+			logrus.Warnf("Skipping container %s: invalid primary IP '%s'", container.Name, container.PrimaryIp)
+			continue
+		}
+
+		for _, port := range lbConfig.TargetPorts() {
+			lbTarget := model.NewLBTarget(ip, port)
+			lbTarget.Protocol = lbConfig.Protocol
+			lbTarget.Weight = targetWeight(container, hosts[container.HostUUID], service)
+			lbConfig.LBTargets = append(lbConfig.LBTargets, lbTarget)
+		}
+	}
+
+	logrus.Debugf("Found %d container IPs for service %s", len(lbConfig.LBTargets), service.Name)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher/external-lb/metrics"
+	"github.com/rancher/external-lb/model"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	reconcileDuration = metrics.NewHistogram("external_lb_reconcile_duration_seconds",
+		"Time taken to apply the LB configs from metadata to the provider.",
+		0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300)
+	providerOps = metrics.NewCounterVec("external_lb_provider_operations_total",
+		"Number of operations applied to the provider.", "provider", "op")
+	providerErrors = metrics.NewCounterVec("external_lb_provider_errors_total",
+		"Number of failed provider API calls.", "provider", "op")
+	metadataFailures = metrics.NewCounterVec("external_lb_metadata_fetch_failures_total",
+		"Number of failures to read the LB configs from metadata.")
+	managedEndpoints = metrics.NewGaugeVec("external_lb_managed_endpoints",
+		"Number of LB endpoints managed by external-lb.", "provider")
+	endpointTargets = metrics.NewGaugeVec("external_lb_endpoint_targets",
+		"Number of targets of each managed LB endpoint.", "endpoint")
+	providerUp = metrics.NewGaugeVec("external_lb_provider_up",
+		"1 if the last health check of the provider succeeded, 0 otherwise.", "provider")
+
+	startTime = time.Now()
+	syncMu    sync.Mutex
+	lastSync  time.Time
+)
+
+func init() {
+	metadataFailures.Init()
+	registry.MustRegister(
+		reconcileDuration,
+		providerOps,
+		providerErrors,
+		metadataFailures,
+		managedEndpoints,
+		endpointTargets,
+		providerUp,
+		metrics.NewGaugeFunc("external_lb_draining_targets",
+			"Number of targets disabled on the provider and waiting for the drain timeout before removal.",
+			func() float64 {
+				return float64(drains.Count())
+			}),
+		metrics.NewGaugeFunc("external_lb_endpoint_conflicts",
+			"Number of services that cannot use their endpoint because another service uses it.",
+			func() float64 {
+				if m == nil {
+					return 0
+				}
+				return float64(len(m.Conflicts()))
+			}),
+		metrics.NewGaugeFunc("external_lb_blocked_changes",
+			"Number of changes blocked by the removal guard in the last update.",
+			func() float64 {
+				return float64(len(guard.Blocked()))
+			}),
+		metrics.NewGaugeFunc("external_lb_leader",
+			"1 if this replica is the leader and updates the provider, 0 if it is on standby.",
+			func() float64 {
+				if isLeader() {
+					return 1
+				}
+				return 0
+			}),
+		metrics.NewGaugeFunc("external_lb_last_successful_sync_timestamp_seconds",
+			"Unix time of the last update that left all endpoints in sync, 0 if there was none.",
+			func() float64 {
+				t := getLastSync()
+				if t.IsZero() {
+					return 0
+				}
+				return float64(t.UnixNano()) / 1e9
+			}),
+		metrics.NewGaugeFunc("external_lb_last_successful_sync_age_seconds",
+			"Seconds since the last update that left all endpoints in sync, or since startup if there was none.",
+			func() float64 {
+				t := getLastSync()
+				if t.IsZero() {
+					t = startTime
+				}
+				return time.Since(t).Seconds()
+			}),
+	)
+}
+
+// recordReconcile updates the metrics after the metadata
+// configs have been applied to the provider.
+func recordReconcile(metadataConfigs map[string]model.LBConfig, start time.Time, err error) {
+	reconcileDuration.Observe(time.Since(start).Seconds())
+
+	for _, p := range lbProviders {
+		managed := 0
+		for _, config := range metadataConfigs {
+			if providerSlug(config) == p.slug {
+				managed++
+			}
+		}
+		managedEndpoints.Set(float64(managed), p.GetName())
+	}
+	endpointTargets.Reset()
+	for endpoint, config := range metadataConfigs {
+		endpointTargets.Set(float64(len(config.LBTargets)), endpoint)
+	}
+
+	if err == nil {
+		syncMu.Lock()
+		lastSync = time.Now()
+		syncMu.Unlock()
+	}
+}
+
+func getLastSync() time.Time {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	return lastSync
+}
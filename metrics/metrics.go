@@ -0,0 +1,279 @@
+// Package metrics implements the subset of Prometheus metric types used by
+// external-lb and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector is a metric family that can write itself in the text format.
+type Collector interface {
+	Write(w io.Writer)
+}
+
+// Registry holds the collectors served by its handler.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// MustRegister adds the collectors to the registry.
+func (r *Registry) MustRegister(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Write writes all registered collectors in the text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		c.Write(w)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// vec holds the values of a metric family keyed by label values.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func (v *vec) init(name, help, typ string, labels []string) {
+	v.name = name
+	v.help = help
+	v.typ = typ
+	v.labels = labels
+	v.values = make(map[string]float64)
+	v.keys = make(map[string][]string)
+}
+
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := v.keys[key]; !ok {
+		v.keys[key] = append([]string(nil), values...)
+	}
+	return key
+}
+
+func (v *vec) add(delta float64, values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[v.key(values)] += delta
+}
+
+func (v *vec) set(value float64, values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[v.key(values)] = value
+}
+
+func (v *vec) get(values []string) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[v.key(values)]
+}
+
+func (v *vec) reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values = make(map[string]float64)
+	v.keys = make(map[string][]string)
+}
+
+func (v *vec) Write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeHeader(w, v.name, v.help, v.typ)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.keys[key]), formatValue(v.values[key]))
+	}
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec returns a counter with the specified label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{}
+	c.init(name, help, "counter", labels)
+	return c
+}
+
+// Inc increments the counter for the label values by one.
+func (c *CounterVec) Inc(values ...string) {
+	c.add(1, values)
+}
+
+// Get returns the current value for the label values.
+func (c *CounterVec) Get(values ...string) float64 {
+	return c.get(values)
+}
+
+// Init exports the counter for the label values at 0 until it is
+// first incremented, so that it is present before any event occurred.
+func (c *CounterVec) Init(values ...string) {
+	c.add(0, values)
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec returns a gauge with the specified label names.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{}
+	g.init(name, help, "gauge", labels)
+	return g
+}
+
+// Set sets the gauge for the label values.
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.set(value, values)
+}
+
+// Get returns the current value for the label values.
+func (g *GaugeVec) Get(values ...string) float64 {
+	return g.get(values)
+}
+
+// Reset removes all label values.
+func (g *GaugeVec) Reset() {
+	g.reset()
+}
+
+// GaugeFunc is a gauge whose value is computed when it is written.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc returns a gauge reporting the value returned by fn.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, fn: fn}
+}
+
+func (g *GaugeFunc) Write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram returns a histogram with the specified upper bounds,
+// which must be sorted in increasing order.
+func NewHistogram(name, help string, buckets ...float64) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds a single observation.
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
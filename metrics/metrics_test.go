@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	ops := NewCounterVec("ops_total", "Operations.", "provider", "op")
+	ops.Inc("F5 BigIP", "UPDATE")
+	ops.Inc("F5 BigIP", "ADD")
+	ops.Inc("F5 BigIP", "ADD")
+
+	failures := NewCounterVec("failures_total", "Failures.")
+	failures.Init()
+	failures.Inc()
+
+	errors := NewCounterVec("errors_total", "Errors.")
+	errors.Init()
+
+	targets := NewGaugeVec("targets", "Targets per endpoint.", "endpoint")
+	targets.Set(3, `vs "a"`)
+	targets.Set(1, "vs-b")
+	targets.Reset()
+	targets.Set(2, `vs "a"`)
+
+	duration := NewHistogram("duration_seconds", "Duration.", 1, 5)
+	duration.Observe(0.5)
+	duration.Observe(3)
+	duration.Observe(10)
+
+	age := NewGaugeFunc("age_seconds", "Age.", func() float64 { return 42.5 })
+
+	r := NewRegistry()
+	r.MustRegister(ops, failures, errors, targets, duration, age)
+
+	want := `# HELP ops_total Operations.
+# TYPE ops_total counter
+ops_total{provider="F5 BigIP",op="ADD"} 2
+ops_total{provider="F5 BigIP",op="UPDATE"} 1
+# HELP failures_total Failures.
+# TYPE failures_total counter
+failures_total 1
+# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total 0
+# HELP targets Targets per endpoint.
+# TYPE targets gauge
+targets{endpoint="vs \"a\""} 2
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="1"} 1
+duration_seconds_bucket{le="5"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 13.5
+duration_seconds_count 3
+# HELP age_seconds Age.
+# TYPE age_seconds gauge
+age_seconds 42.5
+`
+	var buf bytes.Buffer
+	r.Write(&buf)
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if rec.Body.String() != want {
+		t.Errorf("handler body differs from Write output")
+	}
+}
@@ -2,22 +2,130 @@ package model
 
 import (
 	"fmt"
+	"net"
 )
 
+// Transport protocols of LB configs and targets.
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// TargetModeContainer is the target mode of configs whose targets are
+// the IP addresses of containers rather than of their hosts.
+const TargetModeContainer = "container"
+
 type LBConfig struct {
-	LBEndpoint       string
-	LBTargetPoolName string
-	LBTargetPort     string
-	LBTargets        []LBTarget
+	LBEndpoint       string     `json:"endpoint"`
+	LBTargetPoolName string     `json:"poolName"`
+	LBTargetPort     string     `json:"targetPort"`
+	LBTargets        []LBTarget `json:"targets"`
+	// Protocol is the transport protocol of the endpoint, ProtocolTCP or
+	// ProtocolUDP. Providers may leave it empty if they do not know it.
+	Protocol string `json:"protocol,omitempty"`
+	// TargetMode is TargetModeContainer if the targets are containers
+	// reached on their own IP address and private port. It is empty for
+	// targets reached on the published port of their host, and for
+	// configs read from a provider.
+	TargetMode string `json:"targetMode,omitempty"`
+	// Ports lists the target ports of a config serving several ports of
+	// a service, starting with LBTargetPort. It is empty for configs
+	// serving a single port and for configs read from a provider.
+	Ports []string `json:"ports,omitempty"`
+	// Provider is the slug of the provider the config is routed to.
+	// It is empty for configs read from a provider and for services
+	// using the default provider.
+	Provider string `json:"provider,omitempty"`
+	// Scale is the scale of the service the config was created from.
+	// It is 0 for configs read from a provider.
+	Scale int `json:"scale,omitempty"`
+	// Services lists the services whose targets are merged into the
+	// config because they split the traffic of the endpoint by weight.
+	// It is empty for configs of a single service.
+	Services []ServiceRef `json:"services,omitempty"`
+	// Owner is the owner record of the config. It is nil for configs
+	// read from providers that do not store it, and for objects created
+	// before owner records were introduced.
+	Owner *Owner `json:"owner,omitempty"`
+	// FQDN is the FQDN of the endpoint, reported by providers that
+	// support it. It is empty for configs read from metadata.
+	FQDN string `json:"fqdn,omitempty"`
+}
+
+// ServiceRef identifies a Rancher service.
+type ServiceRef struct {
+	Stack string `json:"stack"`
+	Name  string `json:"name"`
+}
+
+func (s ServiceRef) String() string {
+	return s.Stack + "/" + s.Name
 }
 
 type LBTarget struct {
-	HostIP string
-	Port   string
+	// HostIP is the IP address of the target in its canonical form,
+	// e.g. "fd00::1" rather than "fd00:0::1".
+	HostIP string `json:"hostIP"`
+	Port   string `json:"port"`
+	// IP is the parsed HostIP. It is set for targets read from metadata
+	// and may be nil for targets read from a provider, see Addr.
+	IP net.IP `json:"-"`
+	// Protocol is the transport protocol of the target port.
+	Protocol string `json:"protocol,omitempty"`
+	// Disabled is set by providers for targets that are draining
+	// and receive no new connections.
+	Disabled bool `json:"disabled,omitempty"`
+	// Weight is the share of traffic the target receives relative to
+	// the other targets of the endpoint. 0 means the provider default.
+	Weight int `json:"weight,omitempty"`
+}
+
+// TargetPorts returns the target ports of the config.
+func (c LBConfig) TargetPorts() []string {
+	if len(c.Ports) > 0 {
+		return c.Ports
+	}
+	return []string{c.LBTargetPort}
+}
+
+// HasPort returns true if port is one of the target ports of the config.
+func (c LBConfig) HasPort(port string) bool {
+	for _, p := range c.TargetPorts() {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// NewLBTarget returns a target for the IP address and port.
+func NewLBTarget(ip net.IP, port string) LBTarget {
+	return LBTarget{HostIP: ip.String(), IP: ip, Port: port}
+}
+
+// Addr returns the IP address of the target, or nil if
+// HostIP is not a valid IP address.
+func (t LBTarget) Addr() net.IP {
+	if t.IP != nil {
+		return t.IP
+	}
+	return net.ParseIP(t.HostIP)
+}
+
+// IsIPv6 returns true if the target has an IPv6 address.
+func (t LBTarget) IsIPv6() bool {
+	ip := t.Addr()
+	return ip != nil && ip.To4() == nil
+}
+
+// HostPort returns the address of the target in host:port form,
+// with IPv6 addresses enclosed in brackets.
+func (t LBTarget) HostPort() string {
+	return net.JoinHostPort(t.HostIP, t.Port)
 }
 
 func (t LBTarget) String() string {
-	return fmt.Sprintf("(%s:%s)", t.HostIP, t.Port)
+	return fmt.Sprintf("(%s)", t.HostPort())
 }
 
 func (c LBConfig) String() string {
@@ -29,3 +137,48 @@ func (c LBConfig) String() string {
 	return fmt.Sprintf("LBConfig={Endpoint: %s, PoolName: %s, TargetPort: %s, Targets: [%s]}",
 		c.LBEndpoint, c.LBTargetPoolName, c.LBTargetPort, lbTargets)
 }
+
+// DiffLBTargets compares two target lists by host IP and port. It returns
+// the targets in desired that are missing from current, and the targets in
+// current that are missing from desired.
+func DiffLBTargets(desired, current []LBTarget) (added, removed []LBTarget) {
+	for _, d := range desired {
+		if !HasLBTarget(current, d) {
+			added = append(added, d)
+		}
+	}
+	for _, c := range current {
+		if !HasLBTarget(desired, c) {
+			removed = append(removed, c)
+		}
+	}
+	return added, removed
+}
+
+// HasLBTarget returns true if the targets contain one
+// with the host IP and port of the specified target.
+func HasLBTarget(targets []LBTarget, target LBTarget) bool {
+	for _, t := range targets {
+		if t.HostIP == target.HostIP && t.Port == target.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// ReweightedLBTargets returns the targets in desired that are also in
+// current but with a different weight.
+func ReweightedLBTargets(desired, current []LBTarget) []LBTarget {
+	var reweighted []LBTarget
+	for _, d := range desired {
+		for _, c := range current {
+			if c.HostIP == d.HostIP && c.Port == d.Port {
+				if c.Weight != d.Weight {
+					reweighted = append(reweighted, d)
+				}
+				break
+			}
+		}
+	}
+	return reweighted
+}
@@ -0,0 +1,103 @@
+package model
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// OwnerVersion is the schema version of the owner records
+// written by this version of external-lb.
+const OwnerVersion = 1
+
+// Keys of the tags holding the owner record on providers that tag
+// their objects.
+const (
+	OwnerTagEnvironment = "external-lb/environment"
+	OwnerTagService     = "external-lb/service"
+	OwnerTagInstance    = "external-lb/instance"
+	OwnerTagVersion     = "external-lb/version"
+)
+
+// Owner records which external-lb instance manages an object on a
+// provider, and for which service. Providers store it with the object,
+// so that ownership does not depend on the name of the object.
+type Owner struct {
+	// Environment is the UUID of the Rancher environment.
+	Environment string `json:"environment"`
+	// Service is the UUID of the service. It is empty for endpoints
+	// shared by several services splitting its traffic.
+	Service string `json:"service,omitempty"`
+	// Instance identifies the external-lb instance within the
+	// environment, so that several instances can share a provider.
+	Instance string `json:"instance"`
+	// Version is the schema version of the record.
+	Version int `json:"version"`
+}
+
+// String returns the record as JSON, the form in which it is stored
+// in descriptions and metadata fields.
+func (o Owner) String() string {
+	b, _ := json.Marshal(o)
+	return string(b)
+}
+
+// Owns returns true if the record belongs to the instance
+// of the environment.
+func (o Owner) Owns(environment, instance string) bool {
+	return o.Environment == environment && o.Instance == instance
+}
+
+// Tags returns the record as tags.
+func (o Owner) Tags() map[string]string {
+	return map[string]string{
+		OwnerTagEnvironment: o.Environment,
+		OwnerTagService:     o.Service,
+		OwnerTagInstance:    o.Instance,
+		OwnerTagVersion:     strconv.Itoa(o.Version),
+	}
+}
+
+// ParseOwner parses a record in the form returned by String. It returns
+// nil if s is not an owner record, e.g. a description set by hand.
+func ParseOwner(s string) *Owner {
+	if !strings.HasPrefix(s, "{") {
+		return nil
+	}
+	var o Owner
+	if err := json.Unmarshal([]byte(s), &o); err != nil || !o.valid() {
+		return nil
+	}
+	return &o
+}
+
+// OwnerFromTags returns the record held by the tags, or nil
+// if they hold none.
+func OwnerFromTags(tags map[string]string) *Owner {
+	version, err := strconv.Atoi(tags[OwnerTagVersion])
+	if err != nil {
+		return nil
+	}
+	o := Owner{
+		Environment: tags[OwnerTagEnvironment],
+		Service:     tags[OwnerTagService],
+		Instance:    tags[OwnerTagInstance],
+		Version:     version,
+	}
+	if !o.valid() {
+		return nil
+	}
+	return &o
+}
+
+// SameOwner returns true if both records are nil or equal.
+func SameOwner(a, b *Owner) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (o Owner) valid() bool {
+	return o.Environment != "" && o.Instance != "" && o.Version > 0
+}
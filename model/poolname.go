@@ -0,0 +1,149 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxPoolNameLength is the length up to which pool names are kept
+// readable. It fits the limits of all providers, the tightest being the
+// 128 characters of an Aliyun SLB tag value.
+const MaxPoolNameLength = 128
+
+const (
+	poolNameSep    = '_'
+	poolNameEscape = '.'
+	// poolNameHashed marks a name whose head was replaced by a hash
+	poolNameHashed  = 'h'
+	poolNameHashLen = 16
+)
+
+// ErrHashedPoolName is returned by ParsePoolName for names that were
+// too long and had their service or endpoint replaced by a hash.
+var ErrHashedPoolName = errors.New("pool name is hashed")
+
+// PoolName identifies the owner of a target pool. Either Service is set,
+// for the pool of a single service, or Endpoint, for the pool shared by
+// the services splitting the traffic of an endpoint.
+//
+// A pool name is made of the service and stack names, or the endpoint,
+// followed by the environment UUID and the suffix, all separated by "_",
+// e.g. "web_app_1a5_rancher.internal". Underscores and dots in the
+// service, stack and endpoint are escaped by a dot, so that names are
+// decoded unambiguously while names without them keep the format used
+// before the escaping was introduced.
+type PoolName struct {
+	Service     ServiceRef
+	Endpoint    string
+	Environment string
+	Suffix      string
+}
+
+// String returns the encoded pool name. If it would be longer than
+// MaxPoolNameLength, the service or endpoint part is shortened and
+// followed by a hash of it.
+func (n PoolName) String() string {
+	var head string
+	if n.Endpoint != "" {
+		head = escapePoolName(n.Endpoint)
+	} else {
+		head = escapePoolName(n.Service.Name) + string(poolNameSep) + escapePoolName(n.Service.Stack)
+	}
+	tail := string(poolNameSep) + n.Environment + string(poolNameSep) + n.Suffix
+
+	if len(head)+len(tail) <= MaxPoolNameLength {
+		return head + tail
+	}
+	sum := sha256.Sum256([]byte(head))
+	hash := string(poolNameEscape) + string(poolNameHashed) + hex.EncodeToString(sum[:])[:poolNameHashLen]
+	keep := MaxPoolNameLength - len(tail) - len(hash)
+	if keep < 0 {
+		keep = 0
+	}
+	return truncatePoolName(head, keep) + hash + tail
+}
+
+// ParsePoolName decodes a pool name ending with the suffix. It returns
+// ErrHashedPoolName for names that were shortened by a hash, and an error
+// for names that were not created by PoolName, including names created
+// before the escaping was introduced from a service, stack or endpoint
+// containing an underscore.
+func ParsePoolName(name, suffix string) (PoolName, error) {
+	tail := string(poolNameSep) + suffix
+	if !strings.HasSuffix(name, tail) {
+		return PoolName{}, fmt.Errorf("pool name %s does not end with %s", name, tail)
+	}
+
+	var parts []string
+	var part []byte
+	head := strings.TrimSuffix(name, tail)
+	for i := 0; i < len(head); i++ {
+		switch head[i] {
+		case poolNameSep:
+			parts = append(parts, string(part))
+			part = nil
+		case poolNameEscape:
+			if i+1 == len(head) {
+				return PoolName{}, fmt.Errorf("pool name %s has an invalid escape", name)
+			}
+			i++
+			switch head[i] {
+			case poolNameSep, poolNameEscape:
+				part = append(part, head[i])
+			case poolNameHashed:
+				return PoolName{}, ErrHashedPoolName
+			default:
+				return PoolName{}, fmt.Errorf("pool name %s has an invalid escape", name)
+			}
+		default:
+			part = append(part, head[i])
+		}
+	}
+	parts = append(parts, string(part))
+
+	switch len(parts) {
+	case 2:
+		return PoolName{Endpoint: parts[0], Environment: parts[1], Suffix: suffix}, nil
+	case 3:
+		return PoolName{
+			Service:     ServiceRef{Name: parts[0], Stack: parts[1]},
+			Environment: parts[2],
+			Suffix:      suffix,
+		}, nil
+	}
+	return PoolName{}, fmt.Errorf("pool name %s is ambiguous or malformed", name)
+}
+
+func escapePoolName(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == poolNameSep || s[i] == poolNameEscape {
+			b = append(b, poolNameEscape)
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// truncatePoolName cuts an escaped name to at most n bytes
+// without splitting an escape sequence.
+func truncatePoolName(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	i := 0
+	for i < n {
+		step := 1
+		if s[i] == poolNameEscape {
+			step = 2
+		}
+		if i+step > n {
+			break
+		}
+		i += step
+	}
+	return s[:i]
+}
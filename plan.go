@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+)
+
+// Plan holds the changes a reconciliation would apply to a provider.
+type Plan struct {
+	Remove []model.LBConfig
+	Add    []model.LBConfig
+	Update []model.LBConfig
+
+	provider *lbProvider
+	// metadata configs routed to the provider keyed by endpoint
+	desired map[string]model.LBConfig
+	// provider configs keyed by endpoint
+	current map[string]model.LBConfig
+}
+
+// PlanProviderLBConfigs computes the changes needed to bring each provider
+// in line with the metadata configs routed to it without applying them.
+// If the configs of some providers cannot be read, the plans for the others
+// are returned together with an error.
+func PlanProviderLBConfigs(metadataConfigs map[string]model.LBConfig) ([]*Plan, error) {
+	routed, held := routeLBConfigs(metadataConfigs)
+	endpointStatus.SetDesired(routed, held)
+
+	var plans []*Plan
+	var errs []string
+	for _, p := range lbProviders {
+		providerConfigs, err := getProviderLBConfigs(p)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Failed to get LB configs from provider %s: %v", p.slug, err))
+			continue
+		}
+		endpointStatus.SetActual(p.slug, providerConfigs)
+
+		desired := routed[p.slug]
+		changed := getChangedConfigs
+		if _, ok := drains.drainer(p); ok {
+			changed = getDrainChangedConfigs
+		}
+		plan := &Plan{
+			Remove:   withoutEndpoints(getExtraConfigs(desired, providerConfigs), held),
+			Add:      getMissingConfigs(desired, providerConfigs),
+			Update:   changed(desired, providerConfigs),
+			provider: p,
+			desired:  desired,
+			current:  providerConfigs,
+		}
+		if _, ok := p.Provider.(providers.OwnerRecorder); ok {
+			// record the owner of objects created before owner records
+			plan.Force(unownedEndpoints(providerConfigs))
+		}
+		plans = append(plans, plan)
+	}
+
+	if len(errs) > 0 {
+		return plans, errors.New(strings.Join(errs, "; "))
+	}
+	return plans, nil
+}
+
+// Empty returns true if the plan has no changes.
+func (p *Plan) Empty() bool {
+	return len(p.Remove) == 0 && len(p.Add) == 0 && len(p.Update) == 0
+}
+
+// Force adds an update for each of the specified endpoints that is routed
+// to the provider and exists on it, even if their configs are the same.
+func (p *Plan) Force(endpoints map[string]bool) {
+	updating := make(map[string]bool, len(p.Update))
+	for _, config := range p.Update {
+		updating[config.LBEndpoint] = true
+	}
+	for endpoint := range endpoints {
+		config, ok := p.desired[endpoint]
+		if _, exists := p.current[endpoint]; ok && exists && !updating[endpoint] {
+			p.Update = append(p.Update, config)
+		}
+	}
+	sortLBConfigs(p.Update)
+}
+
+// Endpoints returns the set of endpoints changed by the plan.
+func (p *Plan) Endpoints() map[string]bool {
+	endpoints := make(map[string]bool)
+	for _, configs := range [][]model.LBConfig{p.Remove, p.Add, p.Update} {
+		for _, config := range configs {
+			endpoints[config.LBEndpoint] = true
+		}
+	}
+	return endpoints
+}
+
+// Print writes the operations of the plan in the order
+// they would be applied, including per-target changes.
+func (p *Plan) Print(w io.Writer) {
+	if p.Empty() {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+
+	for _, config := range p.Remove {
+		fmt.Fprintf(w, "%s %s pool=%s\n", REMOVE, config.LBEndpoint, config.LBTargetPoolName)
+		printTargets(w, "-", config.LBTargets)
+	}
+
+	for _, config := range p.Add {
+		fmt.Fprintf(w, "%s %s pool=%s port=%s\n", ADD, config.LBEndpoint,
+			config.LBTargetPoolName, strings.Join(config.TargetPorts(), ","))
+		printTargets(w, "+", config.LBTargets)
+	}
+
+	for _, config := range p.Update {
+		current := p.current[config.LBEndpoint]
+		fmt.Fprintf(w, "%s %s pool=%s port=%s\n", UPDATE, config.LBEndpoint,
+			config.LBTargetPoolName, strings.Join(config.TargetPorts(), ","))
+		if current.LBTargetPoolName != config.LBTargetPoolName {
+			fmt.Fprintf(w, "    pool: %s -> %s\n", current.LBTargetPoolName, config.LBTargetPoolName)
+		}
+		if config.Owner != nil && !model.SameOwner(config.Owner, current.Owner) {
+			fmt.Fprintf(w, "    owner: %s\n", config.Owner)
+		}
+		added, removed := model.DiffLBTargets(config.LBTargets, current.LBTargets)
+		printTargets(w, "+", added)
+		printTargets(w, "-", removed)
+		for _, t := range model.ReweightedLBTargets(config.LBTargets, current.LBTargets) {
+			fmt.Fprintf(w, "    ~ %s weight=%d\n", t.HostPort(), t.Weight)
+		}
+	}
+
+	fmt.Fprintf(w, "Plan: %d to add, %d to update, %d to remove\n",
+		len(p.Add), len(p.Update), len(p.Remove))
+}
+
+// unownedEndpoints returns the endpoints of the configs
+// without an owner record.
+func unownedEndpoints(configs map[string]model.LBConfig) map[string]bool {
+	endpoints := make(map[string]bool)
+	for endpoint, config := range configs {
+		if config.Owner == nil {
+			endpoints[endpoint] = true
+		}
+	}
+	return endpoints
+}
+
+// withoutEndpoints returns the configs whose endpoint is not in the set.
+func withoutEndpoints(configs []model.LBConfig, endpoints map[string]string) []model.LBConfig {
+	var kept []model.LBConfig
+	for _, config := range configs {
+		if _, ok := endpoints[config.LBEndpoint]; !ok {
+			kept = append(kept, config)
+		}
+	}
+	return kept
+}
+
+// printPlans writes the plans of all providers. The plans are
+// headed by the provider if there is more than one.
+func printPlans(w io.Writer, plans []*Plan) {
+	for _, plan := range plans {
+		if len(lbProviders) > 1 {
+			fmt.Fprintf(w, "Provider %s:\n", plan.provider.slug)
+		}
+		plan.Print(w)
+	}
+}
+
+func printTargets(w io.Writer, prefix string, targets []model.LBTarget) {
+	for _, t := range targets {
+		fmt.Fprintf(w, "    %s %s\n", prefix, t.HostPort())
+	}
+}
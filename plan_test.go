@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestPlanProviderLBConfigs(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(
+		testConfig("vs-api", poolName("api", "app"), "9090", "10.0.0.2"),
+		testConfig("vs-old", poolName("old", "app"), "7070", "10.0.0.9"),
+		testConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1", "10.0.0.2"),
+	)
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1", "10.0.0.3"),
+		testService("api", "app", "vs-api", "9090", "10.0.0.2"),
+		testService("db", "app", "vs-db", "5432", "10.0.0.4"),
+	}}
+	setTestGlobals(mem, fake)
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plans, err := PlanProviderLBConfigs(metadataConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 {
+		t.Fatalf("got %d plans, want 1", len(plans))
+	}
+	plan := plans[0]
+
+	if calls := mem.Calls(); len(calls) != 0 {
+		t.Errorf("planning made provider calls: %v", calls)
+	}
+
+	var buf bytes.Buffer
+	plan.Print(&buf)
+	want := `REMOVE vs-old pool=old_app_env1_rancher.internal
+    - 10.0.0.9:7070
+ADD vs-db pool=db_app_env1_rancher.internal port=5432
+    + 10.0.0.4:5432
+UPDATE vs-web pool=web_app_env1_rancher.internal port=8080
+    + 10.0.0.3:8080
+    - 10.0.0.2:8080
+Plan: 1 to add, 1 to update, 1 to remove
+`
+	if buf.String() != want {
+		t.Errorf("plan output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	empty := &Plan{current: map[string]model.LBConfig{}}
+	buf.Reset()
+	empty.Print(&buf)
+	if buf.String() != "No changes\n" {
+		t.Errorf("empty plan output: %q", buf.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 
 	"github.com/Sirupsen/logrus"
@@ -31,10 +32,13 @@ const (
 	EnvVarSLBRegionId  = "SLB_REGION_ID"
 	EnvVarSLBVpcId     = "SLB_VPC_ID"
 	EnvVarUsePrivateIP = "SLB_USE_PRIVATE_IP"
+	EnvVarConcurrency  = "SLB_CONCURRENCY"
 )
 
 const (
 	DefaultBackendServerWeight = 100
+	MaxBackendServerWeight     = 100
+	DefaultConcurrency         = 4
 )
 
 type AliyunSLBProvider struct {
@@ -44,6 +48,7 @@ type AliyunSLBProvider struct {
 	vpcId        string
 	regionId     string
 	usePrivateIP bool
+	concurrency  int
 }
 
 func init() {
@@ -72,6 +77,10 @@ func (p *AliyunSLBProvider) Init() error {
 				"representing a boolean value", EnvVarUsePrivateIP)
 		}
 	}
+	p.concurrency, err = providers.ConcurrencyFromEnv(EnvVarConcurrency, DefaultConcurrency)
+	if err != nil {
+		return err
+	}
 	logrus.Debugf("Initializing %s provider", p.GetName())
 
 	p.slbClient = slb.NewSLBClient(accessKeyId, accessKeySecret, common.Region(p.regionId))
@@ -91,6 +100,22 @@ func (p *AliyunSLBProvider) GetName() string {
 	return ProviderName
 }
 
+func (p *AliyunSLBProvider) Concurrency() int {
+	return p.concurrency
+}
+
+// Capabilities reports that targets are registered as whole ECS
+// instances, so the target port is ignored. The weight of an instance
+// is the highest weight of its targets.
+func (p *AliyunSLBProvider) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		Weights:       true,
+		DefaultWeight: DefaultBackendServerWeight,
+		MaxWeight:     MaxBackendServerWeight,
+		FQDN:          true,
+	}
+}
+
 func (p *AliyunSLBProvider) HealthCheck() error {
 	_, err := p.slbClient.DescribeRegions()
 	if err != nil {
@@ -106,19 +131,21 @@ func (p *AliyunSLBProvider) AddLBConfig(config model.LBConfig) (string, error) {
 		return "", err
 	}
 
-	if !p.checkListenersInstancePort(config.LBEndpoint, config.LBTargetPort) {
-		return "", fmt.Errorf(
-			"SLB '%s' is not configured with instance port matching the service port '%s'",
-			config.LBEndpoint, config.LBTargetPort)
+	for _, port := range config.TargetPorts() {
+		if !p.checkListenersInstancePort(config.LBEndpoint, port) {
+			return "", fmt.Errorf(
+				"SLB '%s' is not configured with instance port matching the service port '%s'",
+				config.LBEndpoint, port)
+		}
 	}
 
-	ecsInstanceIds, err := p.getECSInstances(config.LBTargets)
+	ecsInstances, err := p.getECSInstances(config.LBTargets)
 	if err != nil {
 		return "", fmt.Errorf("Failed to get ECS instances: %v", err)
 	}
 
 	// register SLB instances
-	if err := p.ensureBackendInstances(lb.LoadBalancerId, ecsInstanceIds); err != nil {
+	if err := p.ensureBackendInstances(lb.LoadBalancerId, ecsInstances); err != nil {
 		return "", fmt.Errorf("Failed to ensure registered instances: %v", err)
 	}
 
@@ -170,19 +197,21 @@ func (p *AliyunSLBProvider) UpdateLBConfig(config model.LBConfig) (string, error
 		return "", err
 	}
 
-	if !p.checkListenersInstancePort(config.LBEndpoint, config.LBTargetPort) {
-		return "", fmt.Errorf(
-			"SLB '%s' is not configured with instance port matching the service port '%s'",
-			config.LBEndpoint, config.LBTargetPort)
+	for _, port := range config.TargetPorts() {
+		if !p.checkListenersInstancePort(config.LBEndpoint, port) {
+			return "", fmt.Errorf(
+				"SLB '%s' is not configured with instance port matching the service port '%s'",
+				config.LBEndpoint, port)
+		}
 	}
 
-	ecsInstanceIds, err := p.getECSInstances(config.LBTargets)
+	ecsInstances, err := p.getECSInstances(config.LBTargets)
 	if err != nil {
 		return "", fmt.Errorf("Failed to get ECS instances: %v", err)
 	}
 
 	// update SLB instances
-	if err := p.ensureBackendInstances(lb.LoadBalancerId, ecsInstanceIds); err != nil {
+	if err := p.ensureBackendInstances(lb.LoadBalancerId, ecsInstances); err != nil {
 		return "", fmt.Errorf("Failed to ensure registered instances: %v", err)
 	}
 
@@ -201,6 +230,23 @@ func (p *AliyunSLBProvider) UpdateLBConfig(config model.LBConfig) (string, error
 	return lb.Address, nil
 }
 
+// SetOwner tags the SLB with the owner record.
+func (p *AliyunSLBProvider) SetOwner(endpoint string, owner model.Owner) error {
+	lb, err := p.getLoadBalancerById(endpoint)
+	if err != nil {
+		return err
+	}
+	args := &slb.AddTagsArgs{
+		RegionId:       common.Region(p.regionId),
+		LoadBalancerID: lb.LoadBalancerId,
+		Tags:           marshalTags(ownerTags(owner)),
+	}
+	if err := p.slbClient.AddTags(args); err != nil {
+		return fmt.Errorf("Failed to tag SLB with owner: %v", err)
+	}
+	return nil
+}
+
 func (p *AliyunSLBProvider) GetLBConfigs() ([]model.LBConfig, error) {
 	logrus.Debugf("GetLBConfigs =>")
 
@@ -237,7 +283,9 @@ func (p *AliyunSLBProvider) GetLBConfigs() ([]model.LBConfig, error) {
 
 		var targetPoolName, servicePort string
 		var ok bool
+		tagValues := make(map[string]string, len(tags))
 		for _, tag := range tags {
+			tagValues[tag.TagKey] = tag.TagValue
 			if tag.TagKey == TagResourceFlag {
 				ok = true
 			}
@@ -256,20 +304,18 @@ func (p *AliyunSLBProvider) GetLBConfigs() ([]model.LBConfig, error) {
 		lbConfig := model.LBConfig{}
 		lbConfig.LBEndpoint = lb.LoadBalancerName
 		lbConfig.LBTargetPoolName = targetPoolName
+		lbConfig.Owner = model.OwnerFromTags(tagValues)
 
 		var targets []model.LBTarget
 		var registeredInstanceIds []string
 
 		// get currently registered backend instances
-		hsArgs := &slb.DescribeHealthStatusArgs{
-			LoadBalancerId: lb.LoadBalancerId,
-		}
-		healthStatusResonpse, err := p.slbClient.DescribeHealthStatus(hsArgs)
+		registered, err := p.getBackendServers(lb.LoadBalancerId)
 		if err != nil {
 			return lbConfigs, fmt.Errorf("Failed to get registered instance IDs: %v", err)
 		}
-		for _, hst := range healthStatusResonpse.BackendServers.BackendServer {
-			registeredInstanceIds = append(registeredInstanceIds, hst.ServerId)
+		for id := range registered {
+			registeredInstanceIds = append(registeredInstanceIds, id)
 		}
 
 		if len(registeredInstanceIds) > 0 {
@@ -293,6 +339,7 @@ func (p *AliyunSLBProvider) GetLBConfigs() ([]model.LBConfig, error) {
 				target := model.LBTarget{
 					HostIP: ip,
 					Port:   servicePort,
+					Weight: registered[inst.InstanceId],
 				}
 				targets = append(targets, target)
 			}
@@ -322,33 +369,44 @@ func (p *AliyunSLBProvider) getLoadBalancerById(loadBalancerId string) (slb.Load
 	return lbs[0], nil
 }
 
-func (p *AliyunSLBProvider) ensureBackendInstances(loadBalancerId string, instanceIds []string) error {
-	logrus.Debugf("ensureBackendInstances => lb: %s, instanceIds: %v", loadBalancerId, instanceIds)
-	var registeredInstanceIds []string
-
-	args := &slb.DescribeHealthStatusArgs{
-		LoadBalancerId: loadBalancerId,
-	}
-	healthStatusResonpse, err := p.slbClient.DescribeHealthStatus(args)
+// ensureBackendInstances makes sure that exactly the specified instances
+// are registered with the load balancer, with the specified weights.
+func (p *AliyunSLBProvider) ensureBackendInstances(loadBalancerId string, instances map[string]int) error {
+	logrus.Debugf("ensureBackendInstances => lb: %s, instances: %v", loadBalancerId, instances)
+	registered, err := p.getBackendServers(loadBalancerId)
 	if err != nil {
 		return err
 	}
-	for _, hst := range healthStatusResonpse.BackendServers.BackendServer {
-		registeredInstanceIds = append(registeredInstanceIds, hst.ServerId)
-	}
 
-	toRegister := differenceStringSlice(instanceIds, registeredInstanceIds)
-	toDeregister := differenceStringSlice(registeredInstanceIds, instanceIds)
+	var toRegister, toReweight []slb.BackendServerType
+	var toDeregister []string
+	for id, weight := range instances {
+		current, ok := registered[id]
+		switch {
+		case !ok:
+			toRegister = append(toRegister, slb.BackendServerType{ServerId: id, Weight: weight})
+		case current != weight:
+			toReweight = append(toReweight, slb.BackendServerType{ServerId: id, Weight: weight})
+		}
+	}
+	for id := range registered {
+		if _, ok := instances[id]; !ok {
+			toDeregister = append(toDeregister, id)
+		}
+	}
 	logrus.Debugf("Registering instances to SLB %s: %v", loadBalancerId, toRegister)
+	logrus.Debugf("Changing weight of instances of SLB %s: %v", loadBalancerId, toReweight)
 	logrus.Debugf("Deregistering instances from SLB %s: %v", loadBalancerId, toDeregister)
 
 	if len(toRegister) > 0 {
-		var toRegisterBS []slb.BackendServerType
-		for _, id := range toRegister {
-			bs := slb.BackendServerType{ServerId: id, Weight: DefaultBackendServerWeight}
-			toRegisterBS = append(toRegisterBS, bs)
+		_, err := p.slbClient.AddBackendServers(loadBalancerId, toRegister)
+		if err != nil {
+			return err
 		}
-		_, err := p.slbClient.AddBackendServers(loadBalancerId, toRegisterBS)
+	}
+
+	if len(toReweight) > 0 {
+		_, err := p.slbClient.SetBackendServers(loadBalancerId, toReweight)
 		if err != nil {
 			return err
 		}
@@ -364,16 +422,41 @@ func (p *AliyunSLBProvider) ensureBackendInstances(loadBalancerId string, instan
 	return nil
 }
 
-func (p *AliyunSLBProvider) getECSInstances(targets []model.LBTarget) ([]string, error) {
-	var instanceIds []string
+// getBackendServers returns the weights of the instances
+// registered with the load balancer, keyed by instance ID.
+func (p *AliyunSLBProvider) getBackendServers(loadBalancerId string) (map[string]int, error) {
+	lb, err := p.slbClient.DescribeLoadBalancerAttribute(loadBalancerId)
+	if err != nil {
+		return nil, err
+	}
+	servers := make(map[string]int, len(lb.BackendServers.BackendServer))
+	for _, bs := range lb.BackendServers.BackendServer {
+		servers[bs.ServerId] = bs.Weight
+	}
+	return servers, nil
+}
+
+// getECSInstances looks up the ECS instances of the targets and returns
+// their weights keyed by instance ID. An instance hosting several targets
+// gets the highest of their weights.
+func (p *AliyunSLBProvider) getECSInstances(targets []model.LBTarget) (map[string]int, error) {
+	instances := make(map[string]int)
 	var targetIps []string
+	weights := make(map[string]int)
 	for _, t := range targets {
 		targetIps = append(targetIps, t.HostIP)
+		weight := t.Weight
+		if weight == 0 {
+			weight = DefaultBackendServerWeight
+		}
+		if weight > weights[t.HostIP] {
+			weights[t.HostIP] = weight
+		}
 	}
 
 	targetIps = removeDuplicates(targetIps)
 	if len(targetIps) == 0 {
-		return instanceIds, nil
+		return instances, nil
 	}
 
 	args := &ecs.DescribeInstancesArgs{
@@ -399,17 +482,24 @@ func (p *AliyunSLBProvider) getECSInstances(targets []model.LBTarget) ([]string,
 
 	ecsInstances, _, err := p.ecsClient.DescribeInstances(args)
 	if err != nil {
-		return instanceIds, err
+		return instances, err
 	}
 
 	logrus.Debugf("getECSInstances => Looked up %d IP addresses, got %d instances",
 		len(targetIps), len(ecsInstances))
 
 	for _, instance := range ecsInstances {
-		instanceIds = append(instanceIds, instance.InstanceId)
+		weight := DefaultBackendServerWeight
+		for _, ip := range instanceIPs(instance) {
+			if w, ok := weights[ip]; ok {
+				weight = w
+				break
+			}
+		}
+		instances[instance.InstanceId] = weight
 	}
 
-	return instanceIds, nil
+	return instances, nil
 }
 
 func (p *AliyunSLBProvider) checkListenersInstancePort(loadBalancerId string, port string) bool {
@@ -433,12 +523,43 @@ func (p *AliyunSLBProvider) checkListenersInstancePort(loadBalancerId string, po
 	return found
 }
 
+// instanceIPs returns all IP addresses of the instance.
+func instanceIPs(instance ecs.InstanceAttributesType) []string {
+	var ips []string
+	ips = append(ips, instance.InnerIpAddress.IpAddress...)
+	ips = append(ips, instance.PublicIpAddress.IpAddress...)
+	ips = append(ips, instance.VpcAttributes.PrivateIpAddress.IpAddress...)
+	return ips
+}
+
 func getLBTags(config model.LBConfig) string {
 	tags := []map[string]string{
 		{"TagKey": TagNameTargetPool, "TagValue": config.LBTargetPoolName},
 		{"TagKey": TagNameServicePort, "TagValue": config.LBTargetPort},
 		{"TagKey": TagResourceFlag, "TagValue": "Y"},
 	}
+	if config.Owner != nil {
+		tags = append(tags, ownerTags(*config.Owner)...)
+	}
+	return marshalTags(tags)
+}
+
+// ownerTags returns the tags holding the owner record, sorted by key.
+func ownerTags(owner model.Owner) []map[string]string {
+	values := owner.Tags()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tags := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		tags = append(tags, map[string]string{"TagKey": key, "TagValue": values[key]})
+	}
+	return tags
+}
+
+func marshalTags(tags []map[string]string) string {
 	tagsBytes, err := json.Marshal(tags)
 	if err != nil {
 		logrus.Debugf("Failed to marshal tags json: %v", err)
@@ -457,22 +578,3 @@ func removeDuplicates(in []string) (out []string) {
 	}
 	return out
 }
-
-func differenceStringSlice(sliceA []string, sliceB []string) []string {
-	var diff []string
-
-	for _, a := range sliceA {
-		found := false
-		for _, b := range sliceB {
-			if a == b {
-				found = true
-				break
-			}
-		}
-		if !found {
-			diff = append(diff, a)
-		}
-	}
-
-	return diff
-}
@@ -2,6 +2,9 @@ package avi
 
 import (
 	"net/url"
+	"path"
+	"strings"
+	"sync"
 	// "time"
 
 	"github.com/Sirupsen/logrus"
@@ -15,6 +18,11 @@ type AviProvider struct {
 	aviSession *AviSession
 	cfg        *AviConfig
 	cloudRef   string
+
+	mu sync.Mutex
+	// protocols caches the protocol of the network profiles by reference,
+	// profiles cannot change their type
+	protocols map[string]string
 }
 
 func initLogger() {
@@ -73,6 +81,23 @@ func (p *AviProvider) GetName() string {
 	return ProviderName
 }
 
+func (p *AviProvider) Concurrency() int {
+	return p.cfg.concurrency
+}
+
+func (p *AviProvider) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		TargetPorts:      true,
+		Weights:          true,
+		UDP:              true,
+		IPv6:             true,
+		ContainerTargets: true,
+		DefaultWeight:    defaultRatio,
+		MaxWeight:        maxRatio,
+		FQDN:             true,
+	}
+}
+
 func (p *AviProvider) HealthCheck() error {
 	cloudName := p.cfg.cloudName
 	_, err := p.aviSession.GetCloudRef(cloudName)
@@ -92,19 +117,25 @@ func (p *AviProvider) AddLBConfig(config model.LBConfig) (string, error) {
 		return "", err
 	}
 
+	if err := p.checkVsProtocol(vs, config); err != nil {
+		return "", err
+	}
+
+	metadata := p.ownerMetadata(config)
 	poolName := config.LBTargetPoolName
-	pool, err := p.ensureVsHasPool(vs, poolName)
+	pool, err := p.ensureVsHasPool(vs, poolName, config.Owner, metadata)
 	if err != nil {
 		return "", err
 	}
 
+	pool["service_metadata"] = metadata
 	err = p.convergePoolMembers(pool, config, POOL_ADD)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
-	if !VsHasMetadata(vs, p.cfg.lbSuffix) {
-		err := p.updateVsMetadata(vs)
+	if !VsHasMetadata(vs, metadata) {
+		err := p.updateVsMetadata(vs, metadata)
 		if err != nil {
 			return "", err
 		}
@@ -132,7 +163,7 @@ func (p *AviProvider) RemoveLBConfig(config model.LBConfig) error {
 	}
 
 	poolName := config.LBTargetPoolName
-	pool, err := p.checkExisitngPool(vs, poolName)
+	pool, err := p.checkExisitngPool(vs, poolName, config.Owner)
 	if err != nil {
 		return err
 	}
@@ -152,17 +183,29 @@ func (p *AviProvider) UpdateLBConfig(config model.LBConfig) (string, error) {
 		return "", err
 	}
 
+	if err := p.checkVsProtocol(vs, config); err != nil {
+		return "", err
+	}
+
+	metadata := p.ownerMetadata(config)
 	poolName := config.LBTargetPoolName
-	pool, err := p.ensureVsHasPool(vs, poolName)
+	pool, err := p.ensureVsHasPool(vs, poolName, config.Owner, metadata)
 	if err != nil {
 		return "", err
 	}
 
+	pool["service_metadata"] = metadata
 	err = p.convergePoolMembers(pool, config, POOL_RECONCILE)
 	if err != nil {
 		return "", err
 	}
 
+	if !VsHasMetadata(vs, metadata) {
+		if err := p.updateVsMetadata(vs, metadata); err != nil {
+			return "", err
+		}
+	}
+
 	fqdn, err := GetVsFqdn(vs)
 	if err != nil {
 		log.Warnf("%s", err)
@@ -172,6 +215,114 @@ func (p *AviProvider) UpdateLBConfig(config model.LBConfig) (string, error) {
 	return fqdn, nil
 }
 
+// AddTargets adds members to the pool of the VS.
+func (p *AviProvider) AddTargets(endpoint string, targets []model.LBTarget) error {
+	pool, err := p.endpointPool(endpoint)
+	if err != nil {
+		return err
+	}
+	return p.AddPoolMembers(pool, targetsToDockerTasks(endpoint, targets))
+}
+
+// RemoveTargets removes members from the pool of the VS.
+func (p *AviProvider) RemoveTargets(endpoint string, targets []model.LBTarget) error {
+	pool, err := p.endpointPool(endpoint)
+	if err != nil {
+		return err
+	}
+	return p.RemovePoolMembers(pool, targetsToDockerTasks(endpoint, targets))
+}
+
+// DisableTargets disables members of the pool of the VS.
+func (p *AviProvider) DisableTargets(endpoint string, targets []model.LBTarget) error {
+	pool, err := p.endpointPool(endpoint)
+	if err != nil {
+		return err
+	}
+	return p.SetPoolMembersEnabled(pool, targetsToDockerTasks(endpoint, targets), false)
+}
+
+// EnableTargets enables disabled members of the pool of the VS.
+func (p *AviProvider) EnableTargets(endpoint string, targets []model.LBTarget) error {
+	pool, err := p.endpointPool(endpoint)
+	if err != nil {
+		return err
+	}
+	return p.SetPoolMembersEnabled(pool, targetsToDockerTasks(endpoint, targets), true)
+}
+
+// SetTargetWeights sets the ratio of members of the pool of the VS.
+func (p *AviProvider) SetTargetWeights(endpoint string, targets []model.LBTarget) error {
+	pool, err := p.endpointPool(endpoint)
+	if err != nil {
+		return err
+	}
+	return p.SetPoolMembersRatio(pool, targetsToDockerTasks(endpoint, targets))
+}
+
+// SetOwner stores the owner record as service metadata
+// of the VS and its pool.
+func (p *AviProvider) SetOwner(endpoint string, owner model.Owner) error {
+	vs, err := p.GetVS(endpoint)
+	if err != nil {
+		return err
+	}
+	pool, err := p.endpointPool(endpoint)
+	if err != nil {
+		return err
+	}
+
+	pool["service_metadata"] = owner.String()
+	poolUuid := pool["uuid"].(string)
+	res, err := p.aviSession.Put("/api/pool/"+poolUuid, pool)
+	if err != nil {
+		log.Infof("Avi update Pool failed: %v", res)
+		return err
+	}
+
+	return p.updateVsMetadata(vs, owner.String())
+}
+
+// GetDetachedPools returns the pools of the cloud that no VS uses and
+// that carry an owner record or whose name ends with the suffix.
+func (p *AviProvider) GetDetachedPools(suffix string) ([]model.LBConfig, error) {
+	allVses, err := p.GetAllVses()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, vs := range allVses {
+		if poolUrl, ok := vs["pool_ref"].(string); ok {
+			if u, err := url.Parse(poolUrl); err == nil {
+				used[path.Base(u.Path)] = true
+			}
+		}
+	}
+
+	allPools, err := p.GetAllPools()
+	if err != nil {
+		return nil, err
+	}
+	var configs []model.LBConfig
+	for _, pool := range allPools {
+		name, _ := pool["name"].(string)
+		uuid, _ := pool["uuid"].(string)
+		metadata, _ := pool["service_metadata"].(string)
+		owner := model.ParseOwner(metadata)
+		if used[uuid] || !VsFromCloud(pool, p.cloudRef) ||
+			(owner == nil && !strings.HasSuffix(name, "_"+suffix)) {
+			continue
+		}
+		configs = append(configs, model.LBConfig{LBTargetPoolName: name, Owner: owner})
+	}
+	return configs, nil
+}
+
+// RemoveDetachedPool deletes the pool.
+func (p *AviProvider) RemoveDetachedPool(config model.LBConfig) error {
+	return p.DeletePool(config.LBTargetPoolName)
+}
+
 func (p *AviProvider) GetLBConfigs() ([]model.LBConfig, error) {
 	lbConfigs := make([]model.LBConfig, 0)
 	allVses, err := p.GetAllVses()
@@ -0,0 +1,68 @@
+package avi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rancher/external-lb/model"
+)
+
+// fakeController serves the VS vs-1 with the empty pool pool-1,
+// and fails the updates of the pool while failing is set.
+type fakeController struct {
+	failing bool
+}
+
+func (c *fakeController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/api/pool/pool-uuid"):
+		if c.failing {
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"name":"pool-1","uuid":"pool-uuid"}`))
+	case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/api/virtualservice/vs-uuid"):
+		w.Write([]byte(`{"name":"vs-1","uuid":"vs-uuid"}`))
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/api/virtualservice"):
+		w.Write([]byte(`{"count":1,"results":[{"name":"vs-1","uuid":"vs-uuid",` +
+			`"pool_ref":"https://` + r.Host + `/api/pool/pool-uuid","fqdn":"vs-1.example.com"}]}`))
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/api/pool/pool-uuid"):
+		w.Write([]byte(`{"name":"pool-1","uuid":"pool-uuid","servers":[]}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestAddLBConfigPoolUpdateFails(t *testing.T) {
+	controller := &fakeController{failing: true}
+	server := httptest.NewTLSServer(controller)
+	defer server.Close()
+	p := &AviProvider{
+		aviSession: NewAviSession(strings.TrimPrefix(server.URL, "https://"), "admin", "secret", true),
+		cfg:        &AviConfig{lbSuffix: "rancher.internal"},
+	}
+
+	config := model.LBConfig{
+		LBEndpoint:       "vs-1",
+		LBTargetPoolName: "pool-1",
+		LBTargetPort:     "8080",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.1", Port: "8080"}},
+		Protocol:         model.ProtocolTCP,
+	}
+	if _, err := p.AddLBConfig(config); err == nil {
+		t.Error("AddLBConfig succeeded although the pool members could not be added")
+	}
+
+	// the retry succeeds once the controller accepts the update
+	controller.failing = false
+	fqdn, err := p.AddLBConfig(config)
+	if err != nil {
+		t.Fatalf("retried AddLBConfig: %v", err)
+	}
+	if fqdn != "vs-1.example.com" {
+		t.Errorf("fqdn = %q, want vs-1.example.com", fqdn)
+	}
+}
@@ -19,6 +19,9 @@ const (
 	AVI_CA_CERT_PATH         = "AVI_CA_CERT_PATH"
 	AVI_CLOUD_NAME           = "AVI_CLOUD_NAME"
 	LB_TARGET_RANCHER_SUFFIX = "LB_TARGET_RANCHER_SUFFIX"
+	AVI_CONCURRENCY          = "AVI_CONCURRENCY"
+
+	DEFAULT_CONCURRENCY = 8
 
 	// Assume VSes already configured, so following not needed
 	// AVI_DNS_SUBDOMAIN   = "AVI_DNS_SUBDOMAIN"
@@ -37,6 +40,7 @@ type AviConfig struct {
 	cloudName        string
 	dnsSubDomain     string
 	lbSuffix         string
+	concurrency      int
 }
 
 func getAviPasswd() string {
@@ -60,6 +64,7 @@ func GetAviConfig() (*AviConfig, error) {
 	conf[AVI_SSL_VERIFY] = os.Getenv(AVI_SSL_VERIFY)
 	conf[AVI_CA_CERT_PATH] = os.Getenv(AVI_CA_CERT_PATH)
 	conf[LB_TARGET_RANCHER_SUFFIX] = os.Getenv(LB_TARGET_RANCHER_SUFFIX)
+	conf[AVI_CONCURRENCY] = os.Getenv(AVI_CONCURRENCY)
 
 	// Assume VSes already configured in a given cloud only
 	conf[AVI_CLOUD_NAME] = os.Getenv(AVI_CLOUD_NAME)
@@ -142,5 +147,13 @@ func validateConfig(conf map[string]string) (*AviConfig, error) {
 	}
 	cfg.lbSuffix = conf[LB_TARGET_RANCHER_SUFFIX]
 
+	cfg.concurrency = DEFAULT_CONCURRENCY
+	if conf[AVI_CONCURRENCY] != "" {
+		cfg.concurrency, err = strconv.Atoi(conf[AVI_CONCURRENCY])
+		if err != nil || cfg.concurrency < 1 {
+			return cfg, fmt.Errorf("AVI_CONCURRENCY must be a positive integer")
+		}
+	}
+
 	return cfg, nil
 }
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	// "net/http/httputil"
 	"reflect"
+	"sync"
 )
 
 type aviResult struct {
@@ -86,6 +87,10 @@ type AviSession struct {
 
 	// internal: referer field string to use in requests
 	prefix string
+
+	// internal: guards sessionid and csrf_token, which are
+	// updated from the responses of concurrent requests
+	mu sync.Mutex
 }
 
 func NewAviSession(host string, username string, password string, insecure bool) *AviSession {
@@ -103,7 +108,7 @@ func NewAviSession(host string, username string, password string, insecure bool)
 }
 
 func (avisession *AviSession) InitiateSession() error {
-	log.Debug("Initiating session %s, %s, %s", avisession.prefix, avisession.username, avisession.insecure)
+	log.Debugf("Initiating session %s, %s, %t", avisession.prefix, avisession.username, avisession.insecure)
 	if avisession.insecure == true {
 		log.Warn("Strict certificate verification is *DISABLED*")
 	}
@@ -162,11 +167,15 @@ func (avi *AviSession) rest_request(verb string, uri string, payload interface{}
 		return result, errorResult
 	}
 
+	avi.mu.Lock()
+	csrfToken, sessionid := avi.csrf_token, avi.sessionid
+	avi.mu.Unlock()
+
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	if avi.csrf_token != "" {
-		req.Header["X-CSRFToken"] = []string{avi.csrf_token}
-		req.AddCookie(&http.Cookie{Name: "csrftoken", Value: avi.csrf_token})
+	if csrfToken != "" {
+		req.Header["X-CSRFToken"] = []string{csrfToken}
+		req.AddCookie(&http.Cookie{Name: "csrftoken", Value: csrfToken})
 	}
 	if avi.prefix != "" {
 		req.Header.Set("Referer", avi.prefix)
@@ -174,8 +183,8 @@ func (avi *AviSession) rest_request(verb string, uri string, payload interface{}
 	if avi.Tenant != "" {
 		req.Header.Set("X-Avi-Tenant", avi.Tenant)
 	}
-	if avi.sessionid != "" {
-		req.AddCookie(&http.Cookie{Name: "sessionid", Value: avi.sessionid})
+	if sessionid != "" {
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: sessionid})
 	}
 
 	log.Debug("Request headers: ", req.Header)
@@ -194,6 +203,7 @@ func (avi *AviSession) rest_request(verb string, uri string, payload interface{}
 	errorResult.httpStatusCode = resp.StatusCode
 
 	// collect cookies from the resp
+	avi.mu.Lock()
 	for _, cookie := range resp.Cookies() {
 		log.Debug("cookie: ", cookie)
 		if cookie.Name == "csrftoken" {
@@ -204,6 +214,8 @@ func (avi *AviSession) rest_request(verb string, uri string, payload interface{}
 			avi.sessionid = cookie.Value
 		}
 	}
+	sessionid = avi.sessionid
+	avi.mu.Unlock()
 	log.Debug("Response code: ", resp.StatusCode)
 
 	if resp.StatusCode == 419 {
@@ -211,7 +223,7 @@ func (avi *AviSession) rest_request(verb string, uri string, payload interface{}
 		return avi.rest_request(verb, uri, payload)
 	}
 
-	if resp.StatusCode == 401 && len(avi.sessionid) != 0 && uri != "login" {
+	if resp.StatusCode == 401 && len(sessionid) != 0 && uri != "login" {
 		// session expired; initiate session and then retry the request
 		avi.InitiateSession()
 		return avi.rest_request(verb, uri, payload)
@@ -2,6 +2,7 @@ package avi
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
@@ -15,6 +16,12 @@ const (
 	POOL_RECONCILE
 )
 
+const (
+	// server ratio range of Avi
+	defaultRatio = 1
+	maxRatio     = 20
+)
+
 func (p *AviProvider) updateVs(vs map[string]interface{}) error {
 	vsUuid := vs["uuid"].(string)
 	uri := "/api/virtualservice/" + vsUuid
@@ -22,15 +29,30 @@ func (p *AviProvider) updateVs(vs map[string]interface{}) error {
 	return err
 }
 
-func (p *AviProvider) updateVsMetadata(vs map[string]interface{}) error {
+func (p *AviProvider) updateVsMetadata(vs map[string]interface{}, metadata string) error {
 	log.Debugf("Updating service metadata for vs %s",
 		vs["name"].(string))
-	vs["service_metadata"] = p.cfg.lbSuffix
+	vs["service_metadata"] = metadata
 	return p.updateVs(vs)
 }
 
+// ownerMetadata returns the service metadata marking the VS and pool of
+// the config: its owner record, or the LB suffix if it has none.
+func (p *AviProvider) ownerMetadata(config model.LBConfig) string {
+	if config.Owner == nil {
+		return p.cfg.lbSuffix
+	}
+	return config.Owner.String()
+}
+
+// vsOwner returns the owner record in the service metadata of the VS, if any.
+func vsOwner(vs map[string]interface{}) *model.Owner {
+	metadata, _ := vs["service_metadata"].(string)
+	return model.ParseOwner(metadata)
+}
+
 func (p *AviProvider) checkExisitngPool(vs map[string]interface{},
-	rnchrPoolName string) (map[string]interface{}, error) {
+	rnchrPoolName string, owner *model.Owner) (map[string]interface{}, error) {
 	empty := make(map[string]interface{})
 	poolUrl := vs["pool_ref"].(string)
 	u, err := url.Parse(poolUrl)
@@ -48,9 +70,17 @@ func (p *AviProvider) checkExisitngPool(vs map[string]interface{},
 		return aviPool, nil
 	}
 
+	// the pool of the same service under a former name
+	metadata, _ := aviPool["service_metadata"].(string)
+	if poolOwner := model.ParseOwner(metadata); poolOwner != nil && owner != nil &&
+		poolOwner.Owns(owner.Environment, owner.Instance) && poolOwner.Service == owner.Service {
+		aviPool["name"] = rnchrPoolName
+		return aviPool, nil
+	}
+
 	if strings.HasSuffix(aviPoolName, p.cfg.lbSuffix) {
 		vsName := vs["name"].(string)
-		svcName := SvcNameFromRnchrPoolName(aviPoolName)
+		svcName := SvcNameFromRnchrPoolName(aviPoolName, p.cfg.lbSuffix)
 		// go p.RaiseDuplicateLabelEvent(vsName, svcName)
 		err := fmt.Errorf("Lable/VS %s already used by service %s",
 			vsName, svcName)
@@ -63,11 +93,11 @@ func (p *AviProvider) checkExisitngPool(vs map[string]interface{},
 }
 
 func (p *AviProvider) ensureVsHasPool(vs map[string]interface{},
-	poolName string) (map[string]interface{}, error) {
+	poolName string, owner *model.Owner, metadata string) (map[string]interface{}, error) {
 	empty := make(map[string]interface{})
 	if _, ok := vs["pool_ref"]; !ok {
 		// pool doesn't exist; create one
-		pool, err := p.EnsurePoolExists(poolName)
+		pool, err := p.EnsurePoolExists(poolName, metadata)
 		if err != nil {
 			return empty, err
 		}
@@ -81,18 +111,12 @@ func (p *AviProvider) ensureVsHasPool(vs map[string]interface{},
 		return pool, nil
 	}
 
-	return p.checkExisitngPool(vs, poolName)
+	return p.checkExisitngPool(vs, poolName, owner)
 }
 
 func (p *AviProvider) convergePoolMembers(pool map[string]interface{},
 	config model.LBConfig, op int) error {
-	vsName := config.LBEndpoint
-	dockerTasks := NewDockerTasks()
-	for _, host := range config.LBTargets {
-		hostPort, _ := strconv.Atoi(host.Port)
-		dt := NewDockerTask(vsName, "tcp", host.HostIP, hostPort, -1)
-		dockerTasks[dt.Key()] = dt
-	}
+	dockerTasks := targetsToDockerTasks(config.LBEndpoint, config.LBTargets)
 
 	var err error
 	switch op {
@@ -107,6 +131,108 @@ func (p *AviProvider) convergePoolMembers(pool map[string]interface{},
 	return err
 }
 
+func targetsToDockerTasks(vsName string, targets []model.LBTarget) dockerTasks {
+	dockerTasks := NewDockerTasks()
+	for _, host := range targets {
+		hostPort, _ := strconv.Atoi(host.Port)
+		protocol := host.Protocol
+		if protocol == "" {
+			protocol = model.ProtocolTCP
+		}
+		dt := NewDockerTask(vsName, protocol, host.HostIP, hostPort, -1)
+		if host.Weight != 0 {
+			dt.ratio = host.Weight
+		}
+		dockerTasks[dt.Key()] = dt
+	}
+	return dockerTasks
+}
+
+// aviIPAddr returns the Avi IP address object for the address.
+func aviIPAddr(addr string) map[string]interface{} {
+	ipType := "V4"
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		ipType = "V6"
+	}
+	return map[string]interface{}{"type": ipType, "addr": addr}
+}
+
+// vsProtocol returns the transport protocol of the VS, as set by the type
+// of its network profile. The profile is only read the first time it is
+// referenced.
+func (p *AviProvider) vsProtocol(vs map[string]interface{}) (string, error) {
+	ref, ok := vs["network_profile_ref"].(string)
+	if !ok {
+		return model.ProtocolTCP, nil
+	}
+	p.mu.Lock()
+	protocol, ok := p.protocols[ref]
+	p.mu.Unlock()
+	if ok {
+		return protocol, nil
+	}
+
+	res, err := p.aviSession.Get(ref)
+	if err != nil {
+		return "", err
+	}
+	data, ok := res.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("Unexpected response for network profile %s: %v", ref, res)
+	}
+	profile, ok := data["profile"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("Network profile %s has no profile settings", ref)
+	}
+	protocol = model.ProtocolTCP
+	if t, _ := profile["type"].(string); strings.HasPrefix(t, "PROTOCOL_TYPE_UDP") {
+		protocol = model.ProtocolUDP
+	}
+
+	p.mu.Lock()
+	if p.protocols == nil {
+		p.protocols = make(map[string]string)
+	}
+	p.protocols[ref] = protocol
+	p.mu.Unlock()
+	return protocol, nil
+}
+
+// checkVsProtocol returns an error if the VS cannot serve the
+// protocol of the config.
+func (p *AviProvider) checkVsProtocol(vs map[string]interface{}, config model.LBConfig) error {
+	if config.Protocol == "" {
+		return nil
+	}
+	protocol, err := p.vsProtocol(vs)
+	if err != nil {
+		return err
+	}
+	if protocol != config.Protocol {
+		return fmt.Errorf("Virtual Service %s uses a %s network profile, cannot serve %s targets",
+			config.LBEndpoint, protocol, config.Protocol)
+	}
+	return nil
+}
+
+// endpointPool returns the pool of the named VS.
+func (p *AviProvider) endpointPool(vsName string) (map[string]interface{}, error) {
+	vs, err := p.GetVS(vsName)
+	if err != nil {
+		return nil, err
+	}
+
+	poolUrl, ok := vs["pool_ref"].(string)
+	if !ok {
+		return nil, fmt.Errorf("VS %s has no pool", vsName)
+	}
+	u, err := url.Parse(poolUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Invlid pool ref [%s]", poolUrl)
+	}
+	return p.GetPool(u.Path)
+}
+
 func formLBConfig(vs map[string]interface{},
 	pool map[string]interface{}) model.LBConfig {
 	lbTargets := make([]model.LBTarget, 0)
@@ -119,16 +245,26 @@ func formLBConfig(vs map[string]interface{},
 	for _, server := range currMembers {
 		ip := server["ip"].(map[string]interface{})
 		ipAddr := ip["addr"].(string)
+		if parsed := net.ParseIP(ipAddr); parsed != nil {
+			ipAddr = parsed.String()
+		}
 		targetPort := defaultPort
 		if _, ok := server["port"]; ok {
 			targetPort = strconv.FormatInt(int64(server["port"].(float64)), 10)
 		}
-		lbTargets = append(lbTargets, model.LBTarget{HostIP: ipAddr, Port: targetPort})
+		disabled := server["enabled"] == false
+		ratio := defaultRatio
+		if r, ok := server["ratio"].(float64); ok {
+			ratio = int(r)
+		}
+		lbTargets = append(lbTargets, model.LBTarget{HostIP: ipAddr, Port: targetPort, Disabled: disabled, Weight: ratio})
 	}
 
 	vsName := vs["name"].(string)
 	poolName := pool["name"].(string)
-	return model.LBConfig{LBEndpoint: vsName, LBTargetPoolName: poolName, LBTargetPort: defaultPort, LBTargets: lbTargets}
+	fqdn, _ := GetVsFqdn(vs)
+	return model.LBConfig{LBEndpoint: vsName, LBTargetPoolName: poolName, LBTargetPort: defaultPort, LBTargets: lbTargets,
+		Owner: vsOwner(vs), FQDN: fqdn}
 }
 
 func GetVsFqdn(vs map[string]interface{}) (string, error) {
@@ -137,27 +273,27 @@ func GetVsFqdn(vs map[string]interface{}) (string, error) {
 		data = vs["data"].(map[string]interface{})
 	}
 
-	_, hasFQDN := data["fqdn"]
-	if hasFQDN {
-		fqdn := data["fqdn"].(string)
-		if fqdn != "" {
-			return fqdn, nil
-		}
+	if fqdn, ok := data["fqdn"].(string); ok && fqdn != "" {
+		return fqdn, nil
 	}
 
-	_, hasDnsInfo := data["dns_info"]
-	if !hasDnsInfo {
+	dnsInfos, ok := data["dns_info"].([]interface{})
+	if !ok || len(dnsInfos) == 0 {
 		err := fmt.Errorf("DNS Info not found in VS response %s", vs)
 		return "", err
 	}
 
-	dnsInfo := data["dns_info"].([]interface{})[0].(map[string]interface{})
-	return dnsInfo["fqdn"].(string), nil
+	dnsInfo, _ := dnsInfos[0].(map[string]interface{})
+	fqdn, _ := dnsInfo["fqdn"].(string)
+	return fqdn, nil
 }
 
-func SvcNameFromRnchrPoolName(pName string) string {
-	const sep = "_"
-	return strings.Split(pName, sep)[0]
+func SvcNameFromRnchrPoolName(pName string, suffix string) string {
+	name, err := model.ParsePoolName(pName, suffix)
+	if err != nil || name.Endpoint != "" {
+		return pName
+	}
+	return name.Service.String()
 }
 
 func VsFromCloud(vs map[string]interface{}, cloudRef string) bool {
@@ -181,7 +317,7 @@ func VsHasMetadata(vs map[string]interface{}, metadata string) bool {
 
 func (p *AviProvider) IsAssociatedVs(vs map[string]interface{}) bool {
 	if VsFromCloud(vs, p.cloudRef) &&
-		VsHasMetadata(vs, p.cfg.lbSuffix) {
+		(VsHasMetadata(vs, p.cfg.lbSuffix) || vsOwner(vs) != nil) {
 		return true
 	}
 
@@ -71,7 +71,7 @@ func (p *AviProvider) CheckPoolExists(poolName string) (bool, map[string]interfa
 	return true, nres.(map[string]interface{}), nil
 }
 
-func (p *AviProvider) EnsurePoolExists(poolName string) (map[string]interface{}, error) {
+func (p *AviProvider) EnsurePoolExists(poolName string, metadata string) (map[string]interface{}, error) {
 	exists, resp, err := p.CheckPoolExists(poolName)
 	if exists {
 		log.Infof("Pool %s already exists", poolName)
@@ -81,7 +81,7 @@ func (p *AviProvider) EnsurePoolExists(poolName string) (map[string]interface{},
 		return resp, err
 	}
 
-	return p.CreatePool(poolName)
+	return p.CreatePool(poolName, metadata)
 }
 
 func getPoolMembers(pool interface{}) []map[string]interface{} {
@@ -115,8 +115,9 @@ func (p *AviProvider) UpdatePoolMembers(pool map[string]interface{},
 		ipAddr := ip["addr"].(string)
 		port := strconv.FormatInt(int64(server["port"].(float64)), 10)
 		key := makeKey(ipAddr, port)
-		if _, ok := allTasks[key]; ok {
+		if dt, ok := allTasks[key]; ok {
 			// this is retained
+			server["ratio"] = dt.ratio
 			retained = append(retained, server)
 			delete(allTasks, key)
 		}
@@ -125,11 +126,9 @@ func (p *AviProvider) UpdatePoolMembers(pool map[string]interface{},
 	if len(allTasks) >= 1 {
 		for _, dt := range allTasks {
 			server := make(map[string]interface{})
-			ip := make(map[string]interface{})
-			ip["type"] = "V4"
-			ip["addr"] = dt.ipAddr
-			server["ip"] = ip
+			server["ip"] = aviIPAddr(dt.ipAddr)
 			server["port"] = dt.publicPort
+			server["ratio"] = dt.ratio
 			retained = append(retained, server)
 		}
 	}
@@ -203,11 +202,9 @@ func (p *AviProvider) AddPoolMembers(pool map[string]interface{}, addedTasks doc
 
 	for _, dt := range addedTasks {
 		server := make(map[string]interface{})
-		ip := make(map[string]interface{})
-		ip["type"] = "V4"
-		ip["addr"] = dt.ipAddr
-		server["ip"] = ip
+		server["ip"] = aviIPAddr(dt.ipAddr)
 		server["port"] = dt.publicPort
+		server["ratio"] = dt.ratio
 		currMembers = append(currMembers, server)
 		log.Debugf("currMembers in loop: %s", currMembers)
 	}
@@ -223,6 +220,50 @@ func (p *AviProvider) AddPoolMembers(pool map[string]interface{}, addedTasks doc
 	return nil
 }
 
+// SetPoolMembersEnabled enables or disables the given members of the pool.
+// Disabled members get no new connections but keep the established ones.
+func (p *AviProvider) SetPoolMembersEnabled(pool map[string]interface{}, tasks dockerTasks, enabled bool) error {
+	return p.modifyPoolMembers(pool, tasks, func(server map[string]interface{}, _ *dockerTask) {
+		server["enabled"] = enabled
+	})
+}
+
+// SetPoolMembersRatio sets the ratio of the given members of the pool.
+func (p *AviProvider) SetPoolMembersRatio(pool map[string]interface{}, tasks dockerTasks) error {
+	return p.modifyPoolMembers(pool, tasks, func(server map[string]interface{}, dt *dockerTask) {
+		server["ratio"] = dt.ratio
+	})
+}
+
+// modifyPoolMembers applies modify to the members of the pool that
+// match one of the tasks and saves the pool.
+func (p *AviProvider) modifyPoolMembers(pool map[string]interface{}, tasks dockerTasks,
+	modify func(server map[string]interface{}, dt *dockerTask)) error {
+	poolName := pool["name"].(string)
+	poolUuid := pool["uuid"].(string)
+	currMembers := getPoolMembers(pool)
+	servers := make([]interface{}, 0, len(currMembers))
+	for _, server := range currMembers {
+		ip := server["ip"].(map[string]interface{})
+		ipAddr := ip["addr"].(string)
+		port := strconv.FormatInt(int64(server["port"].(float64)), 10)
+		if dt, ok := tasks[makeKey(ipAddr, port)]; ok {
+			modify(server, dt)
+		}
+		servers = append(servers, server)
+	}
+
+	pool["servers"] = servers
+	log.Debugf("pool %s has updated members: %s", poolName, servers)
+	res, err := p.aviSession.Put("/api/pool/"+poolUuid, pool)
+	if err != nil {
+		log.Infof("Avi update Pool failed: %v", res)
+		return err
+	}
+
+	return nil
+}
+
 // deletePool delete the named pool from Avi.
 func (p *AviProvider) DeletePool(poolName string) error {
 	exists, pool, err := p.CheckPoolExists(poolName)
@@ -296,11 +337,32 @@ func (p *AviProvider) GetAllVses() ([]map[string]interface{}, error) {
 	return allVses, nil
 }
 
-func (p *AviProvider) CreatePool(poolName string) (map[string]interface{}, error) {
+func (p *AviProvider) GetAllPools() ([]map[string]interface{}, error) {
+	allPools := make([]map[string]interface{}, 0)
+	res, err := p.aviSession.GetCollection("/api/pool")
+	if err != nil {
+		log.Infof("Get all pools failed: %v", res)
+		return allPools, err
+	}
+
+	for i := 0; i < res.Count; i++ {
+		nres, err := ConvertAviResponseToMapInterface(res.Results[i])
+		if err != nil {
+			log.Infof("Pool unmarshal failed: %v", string(res.Results[i]))
+		} else {
+			allPools = append(allPools, nres.(map[string]interface{}))
+		}
+	}
+
+	return allPools, nil
+}
+
+func (p *AviProvider) CreatePool(poolName string, metadata string) (map[string]interface{}, error) {
 	var resp map[string]interface{}
 	pool := make(map[string]string)
 	pool["name"] = poolName
 	pool["cloud_ref"] = p.cloudRef
+	pool["service_metadata"] = metadata
 
 	pres, err := p.aviSession.Post("/api/pool", pool)
 	if err != nil {
@@ -1,6 +1,7 @@
 package avi
 
 import (
+	"net"
 	"strconv"
 	"strings"
 )
@@ -12,6 +13,7 @@ type dockerTask struct {
 	ipAddr      string // host IP Address hosting container
 	publicPort  int    // publicly exposed port
 	privatePort int    // private port
+	ratio       int    // weight relative to the other pool members
 }
 
 func NewDockerTask(serviceName string,
@@ -19,11 +21,16 @@ func NewDockerTask(serviceName string,
 	ipAddr string,
 	publicPort int,
 	privatePort int) *dockerTask {
-	return &dockerTask{serviceName, portType, ipAddr, publicPort, privatePort}
+	return &dockerTask{serviceName, portType, ipAddr, publicPort, privatePort, defaultRatio}
 }
 
+// makeKey returns the key of the task for the address and port. IPv6
+// addresses are normalized, as Avi may return them in another form.
 func makeKey(ipAddr string, port string) string {
 	const sep = "-"
+	if ip := net.ParseIP(ipAddr); ip != nil {
+		ipAddr = ip.String()
+	}
 	return strings.Join([]string{ipAddr, port}, sep)
 }
 
@@ -28,6 +28,12 @@ const (
 	EnvVarAWSRegion    = "ELBV1_AWS_REGION"
 	EnvVarAWSVpcID     = "ELBV1_AWS_VPCID"
 	EnvVarUsePrivateIP = "ELBV1_USE_PRIVATE_IP"
+	EnvVarConcurrency  = "ELBV1_CONCURRENCY"
+	EnvVarDrainTimeout = "ELBV1_CONNECTION_DRAINING_TIMEOUT"
+)
+
+const (
+	DefaultConcurrency = 4
 )
 
 // AWSELBv1Provider implements the providers.Provider interface.
@@ -36,6 +42,9 @@ type AWSELBv1Provider struct {
 	region       string
 	vpcID        string
 	usePrivateIP bool
+	concurrency  int
+	// connection draining timeout in seconds, 0 leaves the setting alone
+	drainTimeout int64
 }
 
 func init() {
@@ -58,6 +67,19 @@ func (p *AWSELBv1Provider) Init() error {
 		}
 	}
 
+	p.concurrency, err = providers.ConcurrencyFromEnv(EnvVarConcurrency, DefaultConcurrency)
+	if err != nil {
+		return err
+	}
+
+	if env := os.Getenv(EnvVarDrainTimeout); len(env) > 0 {
+		p.drainTimeout, err = strconv.ParseInt(env, 10, 64)
+		if err != nil || p.drainTimeout < 1 || p.drainTimeout > 3600 {
+			return fmt.Errorf("'%s' must be set to a number of seconds "+
+				"between 1 and 3600", EnvVarDrainTimeout)
+		}
+	}
+
 	if p.vpcID == "" || p.region == "" {
 		p.vpcID, p.region, err = elbv1svc.GetInstanceInfo()
 		if err != nil {
@@ -91,6 +113,18 @@ func (*AWSELBv1Provider) GetName() string {
 	return ProviderName
 }
 
+func (p *AWSELBv1Provider) Concurrency() int {
+	return p.concurrency
+}
+
+// Capabilities reports that targets are registered as whole EC2
+// instances, so the target port is ignored.
+func (p *AWSELBv1Provider) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		FQDN: true,
+	}
+}
+
 func (p *AWSELBv1Provider) HealthCheck() error {
 	return p.svc.CheckAPIConnection()
 }
@@ -140,6 +174,7 @@ func (p *AWSELBv1Provider) GetLBConfigs() ([]model.LBConfig, error) {
 		lbConfig := model.LBConfig{}
 		lbConfig.LBEndpoint = *lb.LoadBalancerName
 		lbConfig.LBTargetPoolName = targetPoolName
+		lbConfig.Owner = model.OwnerFromTags(tags)
 		var targets []model.LBTarget
 
 		// get currently registered backend instances
@@ -188,10 +223,16 @@ func (p *AWSELBv1Provider) AddLBConfig(config model.LBConfig) (string, error) {
 		return "", fmt.Errorf("Could not find ELB named '%s'", config.LBEndpoint)
 	}
 
-	if !checkListenersInstancePort(lb, config.LBTargetPort) {
-		return "", fmt.Errorf(
-			"ELB '%s' is not configured with instance port matching the service port '%s'",
-			config.LBEndpoint, config.LBTargetPort)
+	for _, port := range config.TargetPorts() {
+		if !checkListenersInstancePort(lb, port) {
+			return "", fmt.Errorf(
+				"ELB '%s' is not configured with instance port matching the service port '%s'",
+				config.LBEndpoint, port)
+		}
+	}
+
+	if err := p.ensureConnectionDraining(config.LBEndpoint); err != nil {
+		return "", fmt.Errorf("Failed to enable connection draining: %v", err)
 	}
 
 	ec2InstanceIds, err := p.getEC2Instances(config.LBTargets)
@@ -205,12 +246,7 @@ func (p *AWSELBv1Provider) AddLBConfig(config model.LBConfig) (string, error) {
 	}
 
 	// tag the ELB
-	tags := map[string]string{
-		TagNameTargetPool:  config.LBTargetPoolName,
-		TagNameServicePort: config.LBTargetPort,
-	}
-
-	if err := p.svc.AddLBTags(config.LBEndpoint, tags); err != nil {
+	if err := p.svc.AddLBTags(config.LBEndpoint, lbTags(config)); err != nil {
 		return "", fmt.Errorf("Failed to tag ELB: %v", err)
 	}
 
@@ -229,10 +265,16 @@ func (p *AWSELBv1Provider) UpdateLBConfig(config model.LBConfig) (string, error)
 		return "", fmt.Errorf("Could not find ELB named '%s'", config.LBEndpoint)
 	}
 
-	if !checkListenersInstancePort(lb, config.LBTargetPort) {
-		return "", fmt.Errorf(
-			"ELB '%s' is not configured with instance port matching the service port '%s'",
-			config.LBEndpoint, config.LBTargetPort)
+	for _, port := range config.TargetPorts() {
+		if !checkListenersInstancePort(lb, port) {
+			return "", fmt.Errorf(
+				"ELB '%s' is not configured with instance port matching the service port '%s'",
+				config.LBEndpoint, port)
+		}
+	}
+
+	if err := p.ensureConnectionDraining(config.LBEndpoint); err != nil {
+		return "", fmt.Errorf("Failed to enable connection draining: %v", err)
 	}
 
 	ec2InstanceIds, err := p.getEC2Instances(config.LBTargets)
@@ -247,12 +289,7 @@ func (p *AWSELBv1Provider) UpdateLBConfig(config model.LBConfig) (string, error)
 	}
 
 	// update ELB tags
-	tags := map[string]string{
-		TagNameTargetPool:  config.LBTargetPoolName,
-		TagNameServicePort: config.LBTargetPort,
-	}
-
-	if err := p.svc.AddLBTags(config.LBEndpoint, tags); err != nil {
+	if err := p.svc.AddLBTags(config.LBEndpoint, lbTags(config)); err != nil {
 		return "", fmt.Errorf("Failed to update servicePort tag: %v", err)
 	}
 
@@ -285,14 +322,44 @@ func (p *AWSELBv1Provider) RemoveLBConfig(config model.LBConfig) error {
 		return fmt.Errorf("Failed to remove servicePort tag: %v", err)
 	}
 
+	if config.Owner != nil {
+		for key := range config.Owner.Tags() {
+			if err := p.svc.RemoveLBTag(*lb.LoadBalancerName, key); err != nil {
+				return fmt.Errorf("Failed to remove owner tag %s: %v", key, err)
+			}
+		}
+	}
+
 	logrus.Debug("RemoveLBConfigs => Done")
 	return nil
 }
 
+// SetOwner tags the ELB with the owner record.
+func (p *AWSELBv1Provider) SetOwner(endpoint string, owner model.Owner) error {
+	if err := p.svc.AddLBTags(endpoint, owner.Tags()); err != nil {
+		return fmt.Errorf("Failed to tag ELB with owner: %v", err)
+	}
+	return nil
+}
+
 /*
  * Private methods
  */
 
+// lbTags returns the tags of the ELB of the config.
+func lbTags(config model.LBConfig) map[string]string {
+	tags := map[string]string{
+		TagNameTargetPool:  config.LBTargetPoolName,
+		TagNameServicePort: config.LBTargetPort,
+	}
+	if config.Owner != nil {
+		for key, value := range config.Owner.Tags() {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
 // makes sure the specified instances are registered with specified the load balancer
 func (p *AWSELBv1Provider) ensureBackendInstances(loadBalancerName string, instanceIds []string) error {
 	logrus.Debugf("ensureBackendInstances => lb: %s, instanceIds: %v", loadBalancerName, instanceIds)
@@ -321,6 +388,15 @@ func (p *AWSELBv1Provider) ensureBackendInstances(loadBalancerName string, insta
 	return nil
 }
 
+// enables connection draining on the load balancer if a drain timeout
+// is configured, so that deregistered instances finish in-flight requests.
+func (p *AWSELBv1Provider) ensureConnectionDraining(loadBalancerName string) error {
+	if p.drainTimeout == 0 {
+		return nil
+	}
+	return p.svc.EnsureConnectionDraining(loadBalancerName, p.drainTimeout)
+}
+
 // looks up the EC2 instances for each of the HostIP in the
 // specified model.LBTarget slice and returns their IDs.
 func (p *AWSELBv1Provider) getEC2Instances(targets []model.LBTarget) ([]string, error) {
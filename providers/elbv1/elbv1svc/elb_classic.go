@@ -115,6 +115,41 @@ func (svc *ELBClassicService) RemoveLBTag(loadBalancerName string, tagKey string
 	return nil
 }
 
+// EnsureConnectionDraining ensures that connection draining is enabled on
+// the specified load balancer with the specified timeout in seconds, so
+// that deregistered instances keep serving in-flight requests.
+func (svc *ELBClassicService) EnsureConnectionDraining(loadBalancerName string, timeout int64) error {
+	logrus.Debugf("EnsureConnectionDraining => name: %s, timeout: %d", loadBalancerName, timeout)
+	resp, err := svc.elbc.DescribeLoadBalancerAttributes(&elb.DescribeLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String(loadBalancerName),
+	})
+	if err != nil {
+		return fmt.Errorf("DescribeLoadBalancerAttributes SDK error: %v", err)
+	}
+
+	if attrs := resp.LoadBalancerAttributes; attrs != nil && attrs.ConnectionDraining != nil {
+		draining := attrs.ConnectionDraining
+		if aws.BoolValue(draining.Enabled) && aws.Int64Value(draining.Timeout) == timeout {
+			return nil
+		}
+	}
+
+	params := &elb.ModifyLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String(loadBalancerName),
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			ConnectionDraining: &elb.ConnectionDraining{
+				Enabled: aws.Bool(true),
+				Timeout: aws.Int64(timeout),
+			},
+		},
+	}
+	if _, err := svc.elbc.ModifyLoadBalancerAttributes(params); err != nil {
+		return fmt.Errorf("ModifyLoadBalancerAttributes SDK error: %v", err)
+	}
+
+	return nil
+}
+
 // EnsureListenerInstancePort ensures that the specified listener
 // is configured to forward traffic to the specified instance port.
 // If not, it recreates the listener and configures it so, while
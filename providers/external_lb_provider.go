@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/external-lb/model"
+	"os"
+	"strconv"
 )
 
 type Provider interface {
@@ -25,10 +27,136 @@ type Provider interface {
 	GetLBConfigs() ([]model.LBConfig, error)
 }
 
+// ConcurrentProvider is implemented by providers that can apply
+// changes to several endpoints at the same time.
+type ConcurrentProvider interface {
+	// Concurrency returns the maximum number of endpoints
+	// that may be changed concurrently.
+	Concurrency() int
+}
+
+// TargetUpdater is implemented by providers that can add and remove
+// targets of an endpoint without rewriting its whole config.
+type TargetUpdater interface {
+	// AddTargets adds the targets to the pool of the endpoint.
+	AddTargets(endpoint string, targets []model.LBTarget) error
+	// RemoveTargets removes the targets from the pool of the endpoint.
+	RemoveTargets(endpoint string, targets []model.LBTarget) error
+}
+
+// TargetDrainer is implemented by providers that can stop sending new
+// connections to targets while letting established connections finish.
+// Drained targets must be reported with LBTarget.Disabled set.
+type TargetDrainer interface {
+	// DisableTargets drains the targets of the endpoint.
+	DisableTargets(endpoint string, targets []model.LBTarget) error
+	// EnableTargets sends new connections to drained targets again.
+	EnableTargets(endpoint string, targets []model.LBTarget) error
+}
+
+// TargetWeighter is implemented by providers that can change the weights
+// of targets of an endpoint without rewriting its whole config.
+type TargetWeighter interface {
+	// SetTargetWeights sets the weights of the targets of the endpoint.
+	SetTargetWeights(endpoint string, targets []model.LBTarget) error
+}
+
+// OwnerRecorder is implemented by providers that store the owner record
+// of endpoints with their objects and report it in GetLBConfigs. Such
+// providers store the owner of the config in AddLBConfig and UpdateLBConfig.
+type OwnerRecorder interface {
+	// SetOwner stores the owner record of the endpoint.
+	SetOwner(endpoint string, owner model.Owner) error
+}
+
+// PoolCollector is implemented by providers that keep pools which are no
+// longer assigned to an endpoint, and are therefore not reported by
+// GetLBConfigs.
+type PoolCollector interface {
+	// GetDetachedPools returns the pools not assigned to any endpoint
+	// that carry an owner record or whose name ends with the suffix, as
+	// configs without endpoint.
+	GetDetachedPools(suffix string) ([]model.LBConfig, error)
+	// RemoveDetachedPool deletes a pool returned by GetDetachedPools.
+	RemoveDetachedPool(config model.LBConfig) error
+}
+
+// Capabilities describes the parts of an LBConfig a provider can honour.
+type Capabilities struct {
+	// TargetPorts is set if targets are ip:port members. Otherwise the
+	// provider registers whole hosts, which receive traffic on the
+	// instance port of the endpoint's listeners.
+	TargetPorts bool `json:"targetPorts"`
+	// Weights is set if traffic can be distributed by target weight.
+	Weights bool `json:"weights"`
+	// DefaultWeight is the weight the provider gives targets without one.
+	// Providers that set it report the weight of every target.
+	DefaultWeight int `json:"defaultWeight,omitempty"`
+	// MaxWeight is the largest weight the provider accepts, 0 if there
+	// is no limit.
+	MaxWeight int `json:"maxWeight,omitempty"`
+	// HealthMonitors is set if health monitors can be attached to pools.
+	HealthMonitors bool `json:"healthMonitors"`
+	// UDP is set if UDP endpoints can be load balanced.
+	UDP bool `json:"udp"`
+	// IPv6 is set if targets may have IPv6 addresses.
+	IPv6 bool `json:"ipv6"`
+	// ContainerTargets is set if targets may be the IP addresses of
+	// containers rather than of the hosts registered with the provider.
+	ContainerTargets bool `json:"containerTargets"`
+	// FQDN is set if AddLBConfig and UpdateLBConfig return the FQDN
+	// of the endpoint.
+	FQDN bool `json:"fqdn"`
+	// CreateEndpoint is set if AddLBConfig creates missing endpoints
+	// rather than requiring them to exist on the provider.
+	CreateEndpoint bool `json:"createEndpoint"`
+}
+
+// CapableProvider is implemented by providers that declare their
+// capabilities.
+type CapableProvider interface {
+	// Capabilities returns the capabilities of the provider.
+	Capabilities() Capabilities
+}
+
 var (
 	providers = make(map[string]Provider)
 )
 
+// GetConcurrency returns the number of endpoints the specified
+// provider may change concurrently. Providers not implementing
+// ConcurrentProvider change one endpoint at a time.
+func GetConcurrency(provider Provider) int {
+	if p, ok := provider.(ConcurrentProvider); ok && p.Concurrency() > 1 {
+		return p.Concurrency()
+	}
+	return 1
+}
+
+// GetCapabilities returns the capabilities of the specified provider.
+// Providers not implementing CapableProvider are assumed to only
+// support ip:port targets.
+func GetCapabilities(provider Provider) Capabilities {
+	if p, ok := provider.(CapableProvider); ok {
+		return p.Capabilities()
+	}
+	return Capabilities{TargetPorts: true}
+}
+
+// ConcurrencyFromEnv reads the concurrency from the specified
+// environment variable, returning def if it is not set.
+func ConcurrencyFromEnv(envVar string, def int) (int, error) {
+	env := os.Getenv(envVar)
+	if len(env) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(env)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("'%s' must be set to a positive integer", envVar)
+	}
+	return n, nil
+}
+
 func GetProvider(name string) (Provider, error) {
 	if provider, ok := providers[name]; ok {
 		if err := provider.Init(); err != nil {
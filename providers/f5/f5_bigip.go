@@ -2,6 +2,7 @@ package f5
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strings"
 
@@ -14,10 +15,13 @@ import (
 const (
 	ProviderName = "F5 BigIP"
 	ProviderSlug = "f5_BigIP"
+
+	DefaultConcurrency = 2
 )
 
 type F5BigIPProvider struct {
-	client *bigip.BigIP
+	client      *bigip.BigIP
+	concurrency int
 }
 
 func init() {
@@ -38,6 +42,12 @@ func (p *F5BigIPProvider) Init() error {
 		return fmt.Errorf("F5_BIGIP_PWD is not set")
 	}
 
+	concurrency, err := providers.ConcurrencyFromEnv("F5_BIGIP_CONCURRENCY", DefaultConcurrency)
+	if err != nil {
+		return err
+	}
+	p.concurrency = concurrency
+
 	logrus.Debugf("Initializing f5 provider with host: %s, admin: %s, pwd-length: %d",
 		f5_host, f5_admin, len(f5_pwd))
 
@@ -51,10 +61,34 @@ func (p *F5BigIPProvider) Init() error {
 	return nil
 }
 
+const (
+	// member ratio range of BIG-IP
+	defaultRatio = 1
+	maxRatio     = 65535
+	// pool load balancing mode in which member ratios take effect
+	ratioMode = "ratio-member"
+)
+
 func (p *F5BigIPProvider) GetName() string {
 	return ProviderName
 }
 
+func (p *F5BigIPProvider) Concurrency() int {
+	return p.concurrency
+}
+
+func (p *F5BigIPProvider) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		TargetPorts:      true,
+		Weights:          true,
+		UDP:              true,
+		IPv6:             true,
+		ContainerTargets: true,
+		DefaultWeight:    defaultRatio,
+		MaxWeight:        maxRatio,
+	}
+}
+
 func (p *F5BigIPProvider) HealthCheck() error {
 	_, err := p.client.Pools()
 	if err != nil {
@@ -64,9 +98,9 @@ func (p *F5BigIPProvider) HealthCheck() error {
 }
 
 func (p *F5BigIPProvider) AddLBConfig(config model.LBConfig) (string, error) {
-	vServer, err := p.client.GetVirtualServer(config.LBEndpoint)
-	if err != nil || vServer == nil {
-		logrus.Errorf("f5 AddLBConfig: Error getting f5 virtual server, cannot add the config: %v\n", err)
+	err := p.checkVirtualServer(config)
+	if err != nil {
+		logrus.Errorf("f5 AddLBConfig: Cannot add the config: %v\n", err)
 		return "", err
 	} else {
 		//virtualserver exists, add nodes and pool
@@ -104,6 +138,12 @@ func (p *F5BigIPProvider) AddLBConfig(config model.LBConfig) (string, error) {
 		} else {
 			pool.AllowNAT = "yes"
 			pool.AllowSNAT = "yes"
+			if config.Owner != nil {
+				pool.Description = config.Owner.String()
+			}
+			if weighted(nodes) {
+				pool.LoadBalancingMode = ratioMode
+			}
 			err = p.client.ModifyPool(poolName, pool)
 			if err != nil {
 				logrus.Errorf("f5 AddLBConfig: Error modifying the pool: %v\n", err)
@@ -119,8 +159,8 @@ func (p *F5BigIPProvider) AddLBConfig(config model.LBConfig) (string, error) {
 			return "", err
 		}
 		for _, node := range nodes {
-			if !poolMemberExists(poolMembers, node.HostIP+":"+node.Port) {
-				err = p.client.AddPoolMember(poolName, node.HostIP+":"+node.Port)
+			if !poolMemberExists(poolMembers, memberName(node)) {
+				err = p.addPoolMember(poolName, node)
 				if err != nil {
 					logrus.Errorf("f5 AddLBConfig: Error adding member to pool: %v\n", err)
 					return "", err
@@ -145,6 +185,23 @@ func (p *F5BigIPProvider) AddLBConfig(config model.LBConfig) (string, error) {
 	return "", nil
 }
 
+// checkVirtualServer returns an error if the virtual server of the
+// config does not exist or cannot serve the protocol of its targets.
+func (p *F5BigIPProvider) checkVirtualServer(config model.LBConfig) error {
+	vServer, err := p.client.GetVirtualServer(config.LBEndpoint)
+	if err != nil {
+		return fmt.Errorf("Error getting f5 virtual server %s: %v", config.LBEndpoint, err)
+	}
+	if vServer == nil {
+		return fmt.Errorf("f5 virtual server %s does not exist", config.LBEndpoint)
+	}
+	if config.Protocol != "" && vServer.IPProtocol != "any" && vServer.IPProtocol != config.Protocol {
+		return fmt.Errorf("f5 virtual server %s uses protocol %s, cannot serve %s targets",
+			config.LBEndpoint, vServer.IPProtocol, config.Protocol)
+	}
+	return nil
+}
+
 func (p *F5BigIPProvider) nodeExists(name string, nodeIp string) bool {
 	bigIpNode, err := p.client.GetNode(name)
 	if err != nil {
@@ -181,7 +238,33 @@ func poolMemberExists(p *bigip.PoolMembers, member string) bool {
 	return false
 }
 
-//delete the LBConfig (unassign pool from virtualServer, remove pool, remove nodes)
+// memberName returns the name of the pool member of the target. BIG-IP
+// separates the port of IPv6 members with a dot, e.g. "fd00::1.80".
+func memberName(node model.LBTarget) string {
+	if node.IsIPv6() {
+		return node.HostIP + "." + node.Port
+	}
+	return node.HostIP + ":" + node.Port
+}
+
+// parseMemberName returns the target of the named pool member.
+func parseMemberName(name string) (model.LBTarget, bool) {
+	sep := ":"
+	if strings.Count(name, ":") > 1 {
+		sep = "."
+	}
+	i := strings.LastIndex(name, sep)
+	if i < 1 {
+		return model.LBTarget{}, false
+	}
+	node := model.LBTarget{HostIP: name[:i], Port: name[i+1:]}
+	if ip := net.ParseIP(node.HostIP); ip != nil {
+		node.HostIP = ip.String()
+	}
+	return node, true
+}
+
+// delete the LBConfig (unassign pool from virtualServer, remove pool, remove nodes)
 func (p *F5BigIPProvider) RemoveLBConfig(config model.LBConfig) error {
 	_, err := p.client.GetVirtualServer(config.LBEndpoint)
 	if err != nil {
@@ -200,19 +283,22 @@ func (p *F5BigIPProvider) RemoveLBConfig(config model.LBConfig) error {
 		return err
 	}
 
-	poolName := config.LBTargetPoolName
+	p.deletePool(config.LBTargetPoolName)
 
+	logrus.Debugf("f5 RemoveLBConfig: Success")
+	return nil
+}
+
+// deletePool deletes the pool and the nodes of its members. Errors are
+// logged only, f5 refuses to delete nodes that are members of other pools.
+func (p *F5BigIPProvider) deletePool(poolName string) error {
 	poolMembers, err := p.client.PoolMembers(poolName)
 	var nodes []model.LBTarget
 	if err != nil {
-		logrus.Errorf("f5 RemoveLBConfig: Error listing pool members for pool: %s, err: %v\n", poolName, err)
+		logrus.Errorf("f5 deletePool: Error listing pool members for pool: %s, err: %v\n", poolName, err)
 	} else {
 		for _, member := range poolMembers.PoolMembers {
-			nodeParts := strings.Split(member.Name, ":")
-			if len(nodeParts) == 2 {
-				node := model.LBTarget{}
-				node.HostIP = nodeParts[0]
-				node.Port = nodeParts[1]
+			if node, ok := parseMemberName(member.Name); ok {
 				nodes = append(nodes, node)
 			}
 		}
@@ -220,25 +306,62 @@ func (p *F5BigIPProvider) RemoveLBConfig(config model.LBConfig) error {
 	//remove the pool
 	err = p.client.DeletePool(poolName)
 	if err != nil {
-		logrus.Errorf("f5 RemoveLBConfig: Error removing pool: %s , err: %v\n", poolName, err)
+		logrus.Errorf("f5 deletePool: Error removing pool: %s , err: %v\n", poolName, err)
 	}
 	//remove the nodes under the pool
 	for _, node := range nodes {
 		if p.nodeExists(node.HostIP, node.HostIP) {
 			//node exist, delete node
-			err = p.client.DeleteNode(node.HostIP)
-			if err != nil {
-				logrus.Errorf("f5 RemoveLBConfig: Error removing node on f5: %v\n", err)
+			if err := p.client.DeleteNode(node.HostIP); err != nil {
+				logrus.Errorf("f5 deletePool: Error removing node on f5: %v\n", err)
 			}
 		}
 	}
+	return err
+}
 
-	logrus.Debugf("f5 RemoveLBConfig: Success")
-	return nil
+// GetDetachedPools returns the pools that no virtual server uses and
+// that carry an owner record or whose name ends with the suffix.
+func (p *F5BigIPProvider) GetDetachedPools(suffix string) ([]model.LBConfig, error) {
+	vServers, err := p.client.VirtualServers()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list f5 virtual servers: %v", err)
+	}
+	used := make(map[string]bool)
+	for _, vServer := range vServers.VirtualServers {
+		used[strings.TrimPrefix(vServer.Pool, "/Common/")] = true
+	}
+
+	pools, err := p.client.Pools()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list f5 pools: %v", err)
+	}
+	var configs []model.LBConfig
+	for _, pool := range pools.Pools {
+		owner := model.ParseOwner(pool.Description)
+		if used[pool.Name] || (owner == nil && !strings.HasSuffix(pool.Name, "_"+suffix)) {
+			continue
+		}
+		configs = append(configs, model.LBConfig{LBTargetPoolName: pool.Name, Owner: owner})
+	}
+	return configs, nil
+}
+
+// RemoveDetachedPool deletes the pool and the nodes only it used.
+func (p *F5BigIPProvider) RemoveDetachedPool(config model.LBConfig) error {
+	return p.deletePool(config.LBTargetPoolName)
 }
 
 func (p *F5BigIPProvider) UpdateLBConfig(config model.LBConfig) (string, error) {
-	err := p.RemoveLBConfig(config)
+	// check before removing the pool, so that a config that cannot
+	// be added back leaves the current pool in place
+	err := p.checkVirtualServer(config)
+	if err != nil {
+		logrus.Errorf("f5 UpdateLBConfig: Cannot update the config: %v\n", err)
+		return "", err
+	}
+
+	err = p.RemoveLBConfig(config)
 	if err != nil {
 		logrus.Errorf("f5 UpdateLBConfig: Error removing existing config: %v\n", err)
 		return "", err
@@ -254,6 +377,196 @@ func (p *F5BigIPProvider) UpdateLBConfig(config model.LBConfig) (string, error)
 	return "", nil
 }
 
+// AddTargets adds pool members to the pool of the virtual server,
+// leaving the existing members untouched.
+func (p *F5BigIPProvider) AddTargets(endpoint string, targets []model.LBTarget) error {
+	poolName, err := p.virtualServerPool(endpoint)
+	if err != nil {
+		logrus.Errorf("f5 AddTargets: Error getting the pool of virtual server %s: %v\n", endpoint, err)
+		return err
+	}
+
+	for _, node := range targets {
+		if !p.nodeExists(node.HostIP, node.HostIP) {
+			err = p.client.CreateNode(node.HostIP, node.HostIP)
+			if err != nil {
+				logrus.Errorf("f5 AddTargets: Error creating node on f5: %v\n", err)
+				return err
+			}
+		}
+		err = p.addPoolMember(poolName, node)
+		if err != nil {
+			logrus.Errorf("f5 AddTargets: Error adding member to pool: %v\n", err)
+			return err
+		}
+	}
+
+	if weighted(targets) {
+		if err := p.ensureRatioMode(poolName); err != nil {
+			return err
+		}
+	}
+
+	logrus.Debugf("f5 AddTargets: Success")
+	return nil
+}
+
+// RemoveTargets removes pool members from the pool of the virtual server,
+// leaving the other members untouched.
+func (p *F5BigIPProvider) RemoveTargets(endpoint string, targets []model.LBTarget) error {
+	poolName, err := p.virtualServerPool(endpoint)
+	if err != nil {
+		logrus.Errorf("f5 RemoveTargets: Error getting the pool of virtual server %s: %v\n", endpoint, err)
+		return err
+	}
+
+	for _, node := range targets {
+		err = p.client.DeletePoolMember(poolName, memberName(node))
+		if err != nil {
+			logrus.Errorf("f5 RemoveTargets: Error removing member from pool: %v\n", err)
+			return err
+		}
+		// f5 refuses to delete nodes that are still members of other pools
+		if err := p.client.DeleteNode(node.HostIP); err != nil {
+			logrus.Debugf("f5 RemoveTargets: Not removing node %s: %v", node.HostIP, err)
+		}
+	}
+
+	logrus.Debugf("f5 RemoveTargets: Success")
+	return nil
+}
+
+// DisableTargets disables pool members so that they receive no new
+// connections while established connections are allowed to finish.
+func (p *F5BigIPProvider) DisableTargets(endpoint string, targets []model.LBTarget) error {
+	return p.setPoolMemberState(endpoint, targets, "disable")
+}
+
+// EnableTargets enables previously disabled pool members.
+func (p *F5BigIPProvider) EnableTargets(endpoint string, targets []model.LBTarget) error {
+	return p.setPoolMemberState(endpoint, targets, "enable")
+}
+
+func (p *F5BigIPProvider) setPoolMemberState(endpoint string, targets []model.LBTarget, state string) error {
+	poolName, err := p.virtualServerPool(endpoint)
+	if err != nil {
+		logrus.Errorf("f5 setPoolMemberState: Error getting the pool of virtual server %s: %v\n", endpoint, err)
+		return err
+	}
+
+	for _, node := range targets {
+		err = p.client.PoolMemberStatus(poolName, memberName(node), state, "")
+		if err != nil {
+			logrus.Errorf("f5 setPoolMemberState: Error setting member %s:%s to %s: %v\n", node.HostIP, node.Port, state, err)
+			return err
+		}
+	}
+
+	logrus.Debugf("f5 setPoolMemberState: Success")
+	return nil
+}
+
+// SetTargetWeights sets the ratio of pool members.
+func (p *F5BigIPProvider) SetTargetWeights(endpoint string, targets []model.LBTarget) error {
+	poolName, err := p.virtualServerPool(endpoint)
+	if err != nil {
+		logrus.Errorf("f5 SetTargetWeights: Error getting the pool of virtual server %s: %v\n", endpoint, err)
+		return err
+	}
+
+	if weighted(targets) {
+		if err := p.ensureRatioMode(poolName); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range targets {
+		member := &bigip.PoolMember{FullPath: memberName(node), Ratio: ratio(node)}
+		if err := p.client.ModifyPoolMember(poolName, member); err != nil {
+			logrus.Errorf("f5 SetTargetWeights: Error setting ratio of member %s:%s: %v\n", node.HostIP, node.Port, err)
+			return err
+		}
+	}
+
+	logrus.Debugf("f5 SetTargetWeights: Success")
+	return nil
+}
+
+// SetOwner stores the owner record as the description of the pool
+// of the virtual server.
+func (p *F5BigIPProvider) SetOwner(endpoint string, owner model.Owner) error {
+	poolName, err := p.virtualServerPool(endpoint)
+	if err != nil {
+		logrus.Errorf("f5 SetOwner: Error getting the pool of virtual server %s: %v\n", endpoint, err)
+		return err
+	}
+	pool, err := p.client.GetPool(poolName)
+	if err != nil || pool == nil {
+		logrus.Errorf("f5 SetOwner: Error getting the pool %s: %v\n", poolName, err)
+		return fmt.Errorf("Failed to get pool %s: %v", poolName, err)
+	}
+	pool.Description = owner.String()
+	if err := p.client.ModifyPool(poolName, pool); err != nil {
+		logrus.Errorf("f5 SetOwner: Error modifying the pool %s: %v\n", poolName, err)
+		return err
+	}
+	return nil
+}
+
+// addPoolMember adds the target to the pool with its weight as ratio.
+func (p *F5BigIPProvider) addPoolMember(poolName string, node model.LBTarget) error {
+	member := &bigip.PoolMember{Name: memberName(node), Ratio: ratio(node)}
+	return p.client.CreatePoolMember(poolName, member)
+}
+
+// ensureRatioMode makes the pool balance by member ratio,
+// without which the ratio of members has no effect.
+func (p *F5BigIPProvider) ensureRatioMode(poolName string) error {
+	pool, err := p.client.GetPool(poolName)
+	if err != nil {
+		logrus.Errorf("f5 ensureRatioMode: Error getting the pool %s: %v\n", poolName, err)
+		return err
+	}
+	if pool == nil || pool.LoadBalancingMode == ratioMode {
+		return nil
+	}
+	pool.LoadBalancingMode = ratioMode
+	if err := p.client.ModifyPool(poolName, pool); err != nil {
+		logrus.Errorf("f5 ensureRatioMode: Error modifying the pool %s: %v\n", poolName, err)
+		return err
+	}
+	return nil
+}
+
+// weighted returns true if any of the targets has a ratio other than the default.
+func weighted(targets []model.LBTarget) bool {
+	for _, target := range targets {
+		if ratio(target) != defaultRatio {
+			return true
+		}
+	}
+	return false
+}
+
+func ratio(target model.LBTarget) int {
+	if target.Weight == 0 {
+		return defaultRatio
+	}
+	return target.Weight
+}
+
+// virtualServerPool returns the name of the pool assigned to the virtual server.
+func (p *F5BigIPProvider) virtualServerPool(endpoint string) (string, error) {
+	vServer, err := p.client.GetVirtualServer(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if vServer == nil || vServer.Pool == "" {
+		return "", fmt.Errorf("Virtual server %s has no pool", endpoint)
+	}
+	return strings.TrimPrefix(vServer.Pool, "/Common/"), nil
+}
+
 func (p *F5BigIPProvider) GetLBConfigs() ([]model.LBConfig, error) {
 	//list all virtualServers
 	// for each vs -> LBEndpoint
@@ -277,6 +590,10 @@ func (p *F5BigIPProvider) GetLBConfigs() ([]model.LBConfig, error) {
 			lbConfig := model.LBConfig{}
 			lbConfig.LBEndpoint = vServer.Name
 			lbConfig.LBTargetPoolName = pool.Name
+			lbConfig.Owner = model.ParseOwner(pool.Description)
+			if vServer.IPProtocol != "any" {
+				lbConfig.Protocol = vServer.IPProtocol
+			}
 
 			var nodes []model.LBTarget
 
@@ -285,11 +602,13 @@ func (p *F5BigIPProvider) GetLBConfigs() ([]model.LBConfig, error) {
 				logrus.Errorf("f5 GetLBConfigs: Error listing pool members for pool: %s, err: %v\n", pool.Name, err)
 			} else {
 				for _, member := range poolMembers.PoolMembers {
-					nodeParts := strings.Split(member.Name, ":")
-					if len(nodeParts) == 2 {
-						node := model.LBTarget{}
-						node.HostIP = nodeParts[0]
-						node.Port = nodeParts[1]
+					if node, ok := parseMemberName(member.Name); ok {
+						node.Protocol = lbConfig.Protocol
+						node.Disabled = member.Session == "user-disabled"
+						node.Weight = member.Ratio
+						if node.Weight == 0 {
+							node.Weight = defaultRatio
+						}
 						nodes = append(nodes, node)
 					}
 				}
@@ -0,0 +1,64 @@
+package f5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/scottdware/go-bigip"
+)
+
+// fakeBigIP serves a tcp virtual server vs-1 and records
+// the requests that change the configuration.
+type fakeBigIP struct {
+	sync.Mutex
+	changes []string
+}
+
+func (f *fakeBigIP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		f.Lock()
+		f.changes = append(f.changes, r.Method+" "+r.URL.Path)
+		f.Unlock()
+		w.Write([]byte("{}"))
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/ltm/virtual/vs-1") {
+		w.Write([]byte(`{"name":"vs-1","ipProtocol":"tcp","pool":"/Common/pool-1"}`))
+		return
+	}
+	w.Write([]byte("{}"))
+}
+
+func TestUpdateLBConfigProtocol(t *testing.T) {
+	fake := &fakeBigIP{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	p := &F5BigIPProvider{client: bigip.NewSession(server.URL, "admin", "secret", nil)}
+
+	config := model.LBConfig{
+		LBEndpoint:       "vs-1",
+		LBTargetPoolName: "pool-1",
+		LBTargetPort:     "53",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.1", Port: "53"}},
+		Protocol:         "udp",
+	}
+	if _, err := p.UpdateLBConfig(config); err == nil {
+		t.Fatal("UpdateLBConfig of udp targets on a tcp virtual server succeeded")
+	}
+	if len(fake.changes) != 0 {
+		t.Errorf("failed update changed the configuration: %v", fake.changes)
+	}
+
+	config.Protocol = "tcp"
+	if _, err := p.UpdateLBConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.changes) == 0 || fake.changes[0] != "PATCH /mgmt/tm/ltm/virtual/vs-1" {
+		t.Errorf("update changes = %v, want the pool of vs-1 to be unassigned first", fake.changes)
+	}
+}
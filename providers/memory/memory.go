@@ -0,0 +1,284 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+)
+
+const (
+	ProviderName = "In-Memory"
+	ProviderSlug = "memory"
+)
+
+// Call records a single mutating call made against the provider.
+type Call struct {
+	Op     string
+	Config model.LBConfig
+}
+
+func (c Call) String() string {
+	return fmt.Sprintf("%s %s", c.Op, c.Config.LBEndpoint)
+}
+
+// MemoryProvider implements the providers.Provider interface by keeping
+// all LB configs in a map. It does not talk to any external system and
+// is meant to be used as a reference implementation and in tests. It is
+// not registered as a provider, so that it cannot be selected with
+// -provider.
+type MemoryProvider struct {
+	// FqdnSuffix, if set, is appended to the endpoint name to form
+	// the FQDN returned by AddLBConfig and UpdateLBConfig.
+	FqdnSuffix string
+
+	mu      sync.Mutex
+	configs map[string]model.LBConfig
+	errors  map[string]error
+	calls   []Call
+}
+
+// NewMemoryProvider returns an empty in-memory provider.
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{
+		configs: make(map[string]model.LBConfig),
+		errors:  make(map[string]error),
+	}
+}
+
+func (p *MemoryProvider) Init() error {
+	logrus.Infof("Configured %s provider", p.GetName())
+	return nil
+}
+
+func (p *MemoryProvider) GetName() string {
+	return ProviderName
+}
+
+func (p *MemoryProvider) HealthCheck() error {
+	return nil
+}
+
+// Capabilities returns all capabilities, as the provider
+// stores configs without interpreting them.
+func (p *MemoryProvider) Capabilities() providers.Capabilities {
+	return providers.Capabilities{
+		TargetPorts:      true,
+		Weights:          true,
+		HealthMonitors:   true,
+		UDP:              true,
+		IPv6:             true,
+		ContainerTargets: true,
+		FQDN:             p.FqdnSuffix != "",
+		CreateEndpoint:   true,
+	}
+}
+
+func (p *MemoryProvider) AddLBConfig(config model.LBConfig) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, Call{Op: "ADD", Config: config})
+	if err := p.errors[config.LBEndpoint]; err != nil {
+		return "", err
+	}
+	p.configs[config.LBEndpoint] = config
+	return p.fqdn(config), nil
+}
+
+func (p *MemoryProvider) UpdateLBConfig(config model.LBConfig) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, Call{Op: "UPDATE", Config: config})
+	if err := p.errors[config.LBEndpoint]; err != nil {
+		return "", err
+	}
+	if _, ok := p.configs[config.LBEndpoint]; !ok {
+		return "", fmt.Errorf("No LB config for endpoint %s", config.LBEndpoint)
+	}
+	p.configs[config.LBEndpoint] = config
+	return p.fqdn(config), nil
+}
+
+func (p *MemoryProvider) RemoveLBConfig(config model.LBConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, Call{Op: "REMOVE", Config: config})
+	if err := p.errors[config.LBEndpoint]; err != nil {
+		return err
+	}
+	if _, ok := p.configs[config.LBEndpoint]; !ok {
+		return fmt.Errorf("No LB config for endpoint %s", config.LBEndpoint)
+	}
+	delete(p.configs, config.LBEndpoint)
+	return nil
+}
+
+// AddTargets adds the targets to the stored config of the endpoint,
+// skipping those it already has.
+func (p *MemoryProvider) AddTargets(endpoint string, targets []model.LBTarget) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, Call{Op: "ADD_TARGETS", Config: model.LBConfig{LBEndpoint: endpoint, LBTargets: targets}})
+	if err := p.errors[endpoint]; err != nil {
+		return err
+	}
+	config, ok := p.configs[endpoint]
+	if !ok {
+		return fmt.Errorf("No LB config for endpoint %s", endpoint)
+	}
+	added, _ := model.DiffLBTargets(targets, config.LBTargets)
+	config.LBTargets = append(append([]model.LBTarget(nil), config.LBTargets...), added...)
+	p.configs[endpoint] = config
+	return nil
+}
+
+// RemoveTargets removes the targets from the stored config of the endpoint.
+func (p *MemoryProvider) RemoveTargets(endpoint string, targets []model.LBTarget) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, Call{Op: "REMOVE_TARGETS", Config: model.LBConfig{LBEndpoint: endpoint, LBTargets: targets}})
+	if err := p.errors[endpoint]; err != nil {
+		return err
+	}
+	config, ok := p.configs[endpoint]
+	if !ok {
+		return fmt.Errorf("No LB config for endpoint %s", endpoint)
+	}
+	_, kept := model.DiffLBTargets(targets, config.LBTargets)
+	config.LBTargets = kept
+	p.configs[endpoint] = config
+	return nil
+}
+
+// DisableTargets marks the targets of the endpoint as disabled.
+func (p *MemoryProvider) DisableTargets(endpoint string, targets []model.LBTarget) error {
+	return p.modifyTargets("DISABLE_TARGETS", endpoint, targets, func(stored *model.LBTarget, _ model.LBTarget) {
+		stored.Disabled = true
+	})
+}
+
+// EnableTargets clears the disabled mark of the targets of the endpoint.
+func (p *MemoryProvider) EnableTargets(endpoint string, targets []model.LBTarget) error {
+	return p.modifyTargets("ENABLE_TARGETS", endpoint, targets, func(stored *model.LBTarget, _ model.LBTarget) {
+		stored.Disabled = false
+	})
+}
+
+// SetTargetWeights stores the weights of the targets of the endpoint.
+func (p *MemoryProvider) SetTargetWeights(endpoint string, targets []model.LBTarget) error {
+	return p.modifyTargets("WEIGHT_TARGETS", endpoint, targets, func(stored *model.LBTarget, target model.LBTarget) {
+		stored.Weight = target.Weight
+	})
+}
+
+// SetOwner stores the owner record of the endpoint.
+func (p *MemoryProvider) SetOwner(endpoint string, owner model.Owner) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, Call{Op: "SET_OWNER", Config: model.LBConfig{LBEndpoint: endpoint, Owner: &owner}})
+	if err := p.errors[endpoint]; err != nil {
+		return err
+	}
+	config, ok := p.configs[endpoint]
+	if !ok {
+		return fmt.Errorf("No LB config for endpoint %s", endpoint)
+	}
+	config.Owner = &owner
+	p.configs[endpoint] = config
+	return nil
+}
+
+// modifyTargets records the call and applies modify to each stored
+// target of the endpoint that matches one of the targets.
+func (p *MemoryProvider) modifyTargets(op, endpoint string, targets []model.LBTarget,
+	modify func(stored *model.LBTarget, target model.LBTarget)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, Call{Op: op, Config: model.LBConfig{LBEndpoint: endpoint, LBTargets: targets}})
+	if err := p.errors[endpoint]; err != nil {
+		return err
+	}
+	config, ok := p.configs[endpoint]
+	if !ok {
+		return fmt.Errorf("No LB config for endpoint %s", endpoint)
+	}
+	updated := make([]model.LBTarget, len(config.LBTargets))
+	copy(updated, config.LBTargets)
+	for i := range updated {
+		for _, target := range targets {
+			if target.HostIP == updated[i].HostIP && target.Port == updated[i].Port {
+				modify(&updated[i], target)
+			}
+		}
+	}
+	config.LBTargets = updated
+	p.configs[endpoint] = config
+	return nil
+}
+
+// GetLBConfigs returns the stored LB configs sorted by endpoint.
+func (p *MemoryProvider) GetLBConfigs() ([]model.LBConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.configs))
+	for key := range p.configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lbConfigs := make([]model.LBConfig, 0, len(keys))
+	for _, key := range keys {
+		config := p.configs[key]
+		config.FQDN = p.fqdn(config)
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+// SetLBConfigs replaces the stored LB configs without recording any calls.
+func (p *MemoryProvider) SetLBConfigs(configs ...model.LBConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configs = make(map[string]model.LBConfig, len(configs))
+	for _, config := range configs {
+		p.configs[config.LBEndpoint] = config
+	}
+}
+
+// SetError makes all mutating calls for the endpoint fail with err.
+// A nil err clears the failure.
+func (p *MemoryProvider) SetError(endpoint string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.errors, endpoint)
+		return
+	}
+	p.errors[endpoint] = err
+}
+
+// Calls returns the mutating calls recorded since the last Reset.
+func (p *MemoryProvider) Calls() []Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	calls := make([]Call, len(p.calls))
+	copy(calls, p.calls)
+	return calls
+}
+
+// Reset clears the recorded calls.
+func (p *MemoryProvider) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = nil
+}
+
+func (p *MemoryProvider) fqdn(config model.LBConfig) string {
+	if p.FqdnSuffix == "" {
+		return ""
+	}
+	return config.LBEndpoint + "." + p.FqdnSuffix
+}
@@ -0,0 +1,146 @@
+package memory
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/external-lb/model"
+)
+
+func testConfig(endpoint string, hostIPs ...string) model.LBConfig {
+	config := model.LBConfig{LBEndpoint: endpoint, LBTargetPoolName: endpoint + "-pool", LBTargetPort: "80"}
+	for _, ip := range hostIPs {
+		config.LBTargets = append(config.LBTargets, model.LBTarget{HostIP: ip, Port: "80"})
+	}
+	return config
+}
+
+func callStrings(calls []Call) []string {
+	var s []string
+	for _, call := range calls {
+		s = append(s, call.String())
+	}
+	return s
+}
+
+func TestCalls(t *testing.T) {
+	p := NewMemoryProvider()
+	p.SetLBConfigs(testConfig("vs-old", "10.0.0.9"))
+	if calls := p.Calls(); len(calls) != 0 {
+		t.Errorf("SetLBConfigs recorded calls %v", calls)
+	}
+
+	if _, err := p.AddLBConfig(testConfig("vs-web", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UpdateLBConfig(testConfig("vs-web", "10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveLBConfig(testConfig("vs-old")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ADD vs-web", "UPDATE vs-web", "REMOVE vs-old"}
+	if got := callStrings(p.Calls()); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	configs, _ := p.GetLBConfigs()
+	if want := []model.LBConfig{testConfig("vs-web", "10.0.0.2")}; !reflect.DeepEqual(configs, want) {
+		t.Errorf("configs = %v, want %v", configs, want)
+	}
+
+	p.Reset()
+	if calls := p.Calls(); len(calls) != 0 {
+		t.Errorf("calls after Reset = %v, want none", calls)
+	}
+	if configs, _ := p.GetLBConfigs(); len(configs) != 1 {
+		t.Errorf("Reset changed the configs: %v", configs)
+	}
+
+	// updating or removing a missing endpoint fails, but is recorded
+	if _, err := p.UpdateLBConfig(testConfig("vs-missing")); err == nil {
+		t.Error("UpdateLBConfig of a missing endpoint succeeded")
+	}
+	if err := p.RemoveLBConfig(testConfig("vs-missing")); err == nil {
+		t.Error("RemoveLBConfig of a missing endpoint succeeded")
+	}
+	if got, want := callStrings(p.Calls()), []string{"UPDATE vs-missing", "REMOVE vs-missing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestSetError(t *testing.T) {
+	p := NewMemoryProvider()
+	p.SetLBConfigs(testConfig("vs-web", "10.0.0.1"))
+	fail := errors.New("HTTP 500")
+	p.SetError("vs-web", fail)
+	p.SetError("vs-api", fail)
+
+	if _, err := p.AddLBConfig(testConfig("vs-api", "10.0.0.2")); err != fail {
+		t.Errorf("AddLBConfig error = %v, want %v", err, fail)
+	}
+	if err := p.AddTargets("vs-web", testConfig("", "10.0.0.2").LBTargets); err != fail {
+		t.Errorf("AddTargets error = %v, want %v", err, fail)
+	}
+	if err := p.RemoveLBConfig(testConfig("vs-web")); err != fail {
+		t.Errorf("RemoveLBConfig error = %v, want %v", err, fail)
+	}
+	if got, want := callStrings(p.Calls()), []string{"ADD vs-api", "ADD_TARGETS vs-web", "REMOVE vs-web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("failed calls = %v, want %v", got, want)
+	}
+	configs, _ := p.GetLBConfigs()
+	if want := []model.LBConfig{testConfig("vs-web", "10.0.0.1")}; !reflect.DeepEqual(configs, want) {
+		t.Errorf("failed calls changed the configs: %v", configs)
+	}
+
+	p.SetError("vs-web", nil)
+	if err := p.RemoveLBConfig(testConfig("vs-web")); err != nil {
+		t.Errorf("RemoveLBConfig after clearing the error: %v", err)
+	}
+	if _, err := p.AddLBConfig(testConfig("vs-api")); err != fail {
+		t.Errorf("clearing the error of vs-web cleared it for vs-api: %v", err)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	p := NewMemoryProvider()
+	p.SetLBConfigs(testConfig("vs-web", "10.0.0.1", "10.0.0.2"))
+
+	if err := p.AddTargets("vs-web", testConfig("", "10.0.0.2", "10.0.0.3").LBTargets); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveTargets("vs-web", testConfig("", "10.0.0.1").LBTargets); err != nil {
+		t.Fatal(err)
+	}
+	weighted := testConfig("", "10.0.0.3").LBTargets
+	weighted[0].Weight = 5
+	if err := p.SetTargetWeights("vs-web", weighted); err != nil {
+		t.Fatal(err)
+	}
+
+	want := testConfig("vs-web", "10.0.0.2", "10.0.0.3")
+	want.LBTargets[1].Weight = 5
+	configs, _ := p.GetLBConfigs()
+	if !reflect.DeepEqual(configs, []model.LBConfig{want}) {
+		t.Errorf("configs = %v, want %v", configs, want)
+	}
+	wantCalls := []string{"ADD_TARGETS vs-web", "REMOVE_TARGETS vs-web", "WEIGHT_TARGETS vs-web"}
+	if got := callStrings(p.Calls()); !reflect.DeepEqual(got, wantCalls) {
+		t.Errorf("calls = %v, want %v", got, wantCalls)
+	}
+
+	// target calls for an endpoint without pool fail
+	targets := testConfig("", "10.0.0.1").LBTargets
+	if err := p.AddTargets("vs-missing", targets); err == nil {
+		t.Error("AddTargets on a missing endpoint succeeded")
+	}
+	if err := p.RemoveTargets("vs-missing", targets); err == nil {
+		t.Error("RemoveTargets on a missing endpoint succeeded")
+	}
+	if err := p.SetTargetWeights("vs-missing", targets); err == nil {
+		t.Error("SetTargetWeights on a missing endpoint succeeded")
+	}
+	if configs, _ := p.GetLBConfigs(); len(configs) != 1 {
+		t.Errorf("target calls on a missing endpoint created configs: %v", configs)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryBaseDelay = 5 * time.Second
+	defaultRetryMaxDelay  = 5 * time.Minute
+	retryJitter           = 0.2
+)
+
+type retryEntry struct {
+	op       Op
+	failures int
+	next     time.Time
+	lastErr  error
+}
+
+// RetryQueue tracks failed provider operations per LB endpoint. An endpoint
+// whose last operation failed is not retried before its backoff delay has
+// passed. The delay doubles with every consecutive failure, up to a maximum.
+type RetryQueue struct {
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	// onReady is called when the backoff of an endpoint has expired.
+	onReady func()
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	entries map[string]*retryEntry
+}
+
+// NewRetryQueue returns an empty retry queue.
+func NewRetryQueue(baseDelay, maxDelay time.Duration) *RetryQueue {
+	if maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+	return &RetryQueue{
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		now:       time.Now,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		entries:   make(map[string]*retryEntry),
+	}
+}
+
+// Ready returns false if the endpoint is still backing off.
+func (q *RetryQueue) Ready(endpoint string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.entries[endpoint]
+	return !ok || !q.now().Before(entry.next)
+}
+
+// Failed records a failed operation for the endpoint and
+// returns the delay before it should be retried.
+func (q *RetryQueue) Failed(endpoint string, op Op, err error) time.Duration {
+	q.mu.Lock()
+	entry, ok := q.entries[endpoint]
+	if !ok {
+		entry = &retryEntry{}
+		q.entries[endpoint] = entry
+	}
+	entry.op = op
+	entry.lastErr = err
+	entry.failures++
+	delay := q.backoff(entry.failures)
+	entry.next = q.now().Add(delay)
+	onReady := q.onReady
+	q.mu.Unlock()
+
+	if onReady != nil {
+		time.AfterFunc(delay, onReady)
+	}
+	return delay
+}
+
+// Succeeded removes the endpoint from the queue.
+func (q *RetryQueue) Succeeded(endpoint string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.entries, endpoint)
+}
+
+// Failures returns the number of consecutive failures of
+// the endpoint and the error of the last failed operation.
+func (q *RetryQueue) Failures(endpoint string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, ok := q.entries[endpoint]; ok {
+		return entry.failures, entry.lastErr
+	}
+	return 0, nil
+}
+
+// Len returns the number of endpoints in the queue.
+func (q *RetryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Prune removes all endpoints not in the keep set.
+func (q *RetryQueue) Prune(keep map[string]bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for endpoint := range q.entries {
+		if !keep[endpoint] {
+			delete(q.entries, endpoint)
+		}
+	}
+}
+
+// backoff returns the capped exponential delay for the specified
+// number of failures with up to retryJitter of random delay added.
+func (q *RetryQueue) backoff(failures int) time.Duration {
+	delay := q.baseDelay
+	for i := 1; i < failures && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	return delay + time.Duration(retryJitter*q.rand.Float64()*float64(delay))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestRetryQueueBackoff(t *testing.T) {
+	q := NewRetryQueue(time.Second, 10*time.Second)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, w := range want {
+		delay := q.Failed("vs", UPDATE, errors.New("boom"))
+		min := w * time.Second
+		max := min + time.Duration(retryJitter*float64(min))
+		if delay < min || delay > max {
+			t.Errorf("failure %d: delay %v, want between %v and %v", i+1, delay, min, max)
+		}
+	}
+
+	if q.Ready("vs") {
+		t.Error("endpoint is ready while backing off")
+	}
+	if !q.Ready("other") {
+		t.Error("unrelated endpoint is not ready")
+	}
+
+	now = now.Add(13 * time.Second)
+	if !q.Ready("vs") {
+		t.Error("endpoint is not ready after backoff expired")
+	}
+
+	q.Succeeded("vs")
+	if failures, _ := q.Failures("vs"); failures != 0 {
+		t.Errorf("failures after success = %d, want 0", failures)
+	}
+}
+
+func TestUpdateProviderLBConfigsBacksOff(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	fake := &fakeMetadata{services: []rmetadata.Service{
+		testService("web", "app", "vs-web", "8080", "10.0.0.1"),
+		testService("api", "app", "vs-api", "9090", "10.0.0.2"),
+	}}
+	setTestGlobals(mem, fake)
+	now := time.Now()
+	retries.now = func() time.Time { return now }
+	mem.SetError("vs-api", errors.New("HTTP 429 Too Many Requests"))
+
+	reconcileCalls := func(wantErr bool) []string {
+		mem.Reset()
+		metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := UpdateProviderLBConfigs(metadataConfigs); (err != nil) != wantErr {
+			t.Errorf("UpdateProviderLBConfigs error = %v, want error: %t", err, wantErr)
+		}
+		return callStrings(mem.Calls())
+	}
+
+	if got, want := reconcileCalls(true), []string{"ADD vs-api", "ADD vs-web"}; !equalStrings(got, want) {
+		t.Errorf("first pass calls = %v, want %v", got, want)
+	}
+
+	// the failed endpoint is not retried before its backoff expires
+	if got := reconcileCalls(true); len(got) != 0 {
+		t.Errorf("calls while backing off = %v, want none", got)
+	}
+
+	now = now.Add(time.Duration((1 + retryJitter) * float64(defaultRetryBaseDelay)))
+	if got, want := reconcileCalls(true), []string{"ADD vs-api"}; !equalStrings(got, want) {
+		t.Errorf("calls after backoff = %v, want %v", got, want)
+	}
+	if failures, _ := retries.Failures("vs-api"); failures != 2 {
+		t.Errorf("failures = %d, want 2", failures)
+	}
+
+	mem.SetError("vs-api", nil)
+	now = now.Add(defaultRetryMaxDelay * 2)
+	if got, want := reconcileCalls(false), []string{"ADD vs-api"}; !equalStrings(got, want) {
+		t.Errorf("calls after recovery = %v, want %v", got, want)
+	}
+	if failures, _ := retries.Failures("vs-api"); failures != 0 {
+		t.Errorf("failures after success = %d, want 0", failures)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+)
+
+// lbProvider is an initialized provider together with
+// the settings used when applying changes to it.
+type lbProvider struct {
+	providers.Provider
+	// slug is the name the provider is registered under, which
+	// services use to select it.
+	slug        string
+	concurrency int
+	caps        providers.Capabilities
+}
+
+func newLBProvider(slug string, p providers.Provider) *lbProvider {
+	return &lbProvider{
+		Provider:    p,
+		slug:        slug,
+		concurrency: providers.GetConcurrency(p),
+		caps:        providers.GetCapabilities(p),
+	}
+}
+
+// lbProviders holds the configured providers. Services that do not
+// select a provider are routed to the first one.
+var lbProviders []*lbProvider
+
+// routeLBConfigs splits the metadata configs by the provider they are
+// routed to, keyed by provider slug. Every configured provider has an
+// entry, so that configs no longer routed to it are removed.
+//
+// Configs selecting a provider that is not configured, or that the
+// provider cannot honour, are skipped. Their endpoints are returned as
+// held, with the reason, and must be left untouched on all providers.
+func routeLBConfigs(metadataConfigs map[string]model.LBConfig) (routed map[string]map[string]model.LBConfig, held map[string]string) {
+	routed = make(map[string]map[string]model.LBConfig, len(lbProviders))
+	bySlug := make(map[string]*lbProvider, len(lbProviders))
+	for _, p := range lbProviders {
+		routed[p.slug] = make(map[string]model.LBConfig)
+		bySlug[p.slug] = p
+	}
+	held = make(map[string]string)
+
+	for endpoint, config := range metadataConfigs {
+		slug := providerSlug(config)
+		p, ok := bySlug[slug]
+		if !ok {
+			held[endpoint] = fmt.Sprintf("provider '%s' is not configured", slug)
+			logrus.Errorf("Skipping LB config for endpoint %s: %s", endpoint, held[endpoint])
+			continue
+		}
+		config, err := checkCapabilities(p, config)
+		if err != nil {
+			held[endpoint] = err.Error()
+			logrus.Errorf("Skipping LB config for endpoint %s: %s", endpoint, held[endpoint])
+			continue
+		}
+		routed[slug][endpoint] = config
+	}
+	return routed, held
+}
+
+// providerSlug returns the slug of the provider the config is routed to.
+func providerSlug(config model.LBConfig) string {
+	if config.Provider == "" {
+		return lbProviders[0].slug
+	}
+	return config.Provider
+}
+
+// checkCapabilities returns the config without the targets the provider
+// cannot use, logging a warning for each. An error is returned if the
+// provider cannot honour the config at all.
+func checkCapabilities(p *lbProvider, config model.LBConfig) (model.LBConfig, error) {
+	if len(config.Services) > 0 && !p.caps.Weights {
+		return config, fmt.Errorf("provider %s cannot split the traffic of services %v by weight",
+			p.slug, config.Services)
+	}
+	if config.TargetMode == model.TargetModeContainer && !p.caps.ContainerTargets {
+		return config, fmt.Errorf("provider %s registers hosts and cannot target containers directly", p.slug)
+	}
+	if config.Protocol == model.ProtocolUDP && !p.caps.UDP {
+		return config, fmt.Errorf("provider %s does not support UDP endpoints", p.slug)
+	}
+	if len(config.LBTargets) == 0 {
+		return config, nil
+	}
+	if len(config.Services) > 0 {
+		config.LBTargets = scaleWeights(p, config.LBTargets)
+	}
+
+	var targets []model.LBTarget
+	for _, target := range config.LBTargets {
+		if !p.caps.IPv6 && target.IsIPv6() {
+			logrus.Warnf("Ignoring target %s of endpoint %s: provider %s does not support IPv6",
+				target, config.LBEndpoint, p.slug)
+			continue
+		}
+		if !p.caps.TargetPorts && target.Port != config.LBTargetPort {
+			if !config.HasPort(target.Port) {
+				return config, fmt.Errorf("provider %s registers whole hosts and cannot send traffic to port %s of target %s",
+					p.slug, target.Port, target.HostIP)
+			}
+			// the host is registered once and receives the traffic
+			// of all listeners of the endpoint
+			target.Port = config.LBTargetPort
+		}
+		target.Weight = checkWeight(p, config.LBEndpoint, target)
+		targets = appendTarget(targets, target)
+	}
+
+	if len(targets) == 0 {
+		return config, fmt.Errorf("provider %s cannot use any of its targets", p.slug)
+	}
+	config.LBTargets = targets
+	return config, nil
+}
+
+// appendTarget appends the target unless the targets already have one with
+// the same host IP and port, in which case the higher weight is kept.
+func appendTarget(targets []model.LBTarget, target model.LBTarget) []model.LBTarget {
+	for i, t := range targets {
+		if t.HostIP == target.HostIP && t.Port == target.Port {
+			if target.Weight > t.Weight {
+				targets[i].Weight = target.Weight
+			}
+			return targets
+		}
+	}
+	return append(targets, target)
+}
+
+// scaleWeights returns the targets with their weights scaled down in
+// proportion if any of them exceeds the maximum weight of the provider.
+func scaleWeights(p *lbProvider, targets []model.LBTarget) []model.LBTarget {
+	max := 0
+	for _, target := range targets {
+		if target.Weight > max {
+			max = target.Weight
+		}
+	}
+	if p.caps.MaxWeight == 0 || max <= p.caps.MaxWeight {
+		return targets
+	}
+
+	scaled := make([]model.LBTarget, len(targets))
+	for i, target := range targets {
+		target.Weight = (target.Weight*p.caps.MaxWeight + max/2) / max
+		if target.Weight < 1 {
+			target.Weight = 1
+		}
+		scaled[i] = target
+	}
+	return scaled
+}
+
+// checkWeight returns the weight of the target as the provider will
+// report it: the provider default if the target has none, capped at the
+// maximum weight of the provider, or 0 if the provider ignores weights.
+func checkWeight(p *lbProvider, endpoint string, target model.LBTarget) int {
+	weight := target.Weight
+	switch {
+	case !p.caps.Weights:
+		if weight != 0 {
+			logrus.Warnf("Ignoring weight of target %s of endpoint %s: provider %s does not support weights",
+				target, endpoint, p.slug)
+		}
+		return 0
+	case weight == 0:
+		return p.caps.DefaultWeight
+	case p.caps.MaxWeight > 0 && weight > p.caps.MaxWeight:
+		logrus.Warnf("Lowering weight %d of target %s of endpoint %s to %d, the maximum of provider %s",
+			weight, target, endpoint, p.caps.MaxWeight, p.slug)
+		return p.caps.MaxWeight
+	}
+	return weight
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"github.com/rancher/external-lb/providers/memory"
+	rmetadata "github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// capsProvider overrides the capabilities of a provider.
+type capsProvider struct {
+	providers.Provider
+	caps providers.Capabilities
+}
+
+func (p capsProvider) Capabilities() providers.Capabilities {
+	return p.caps
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	config := testConfig("vs-web", poolName("web", "app"), "8080", "10.0.0.1", "fd00::1")
+	mem := memory.NewMemoryProvider()
+
+	p := newLBProvider("memory", mem)
+	got, err := checkCapabilities(p, config)
+	if err != nil || len(got.LBTargets) != 2 {
+		t.Errorf("full capabilities: got %v, %v", got, err)
+	}
+
+	p = newLBProvider("ipv4", capsProvider{mem, providers.Capabilities{TargetPorts: true}})
+	got, err = checkCapabilities(p, config)
+	if err != nil || len(got.LBTargets) != 1 || got.LBTargets[0].HostIP != "10.0.0.1" {
+		t.Errorf("without IPv6: got %v, %v", got, err)
+	}
+	if len(config.LBTargets) != 2 {
+		t.Errorf("checkCapabilities modified its argument: %v", config)
+	}
+
+	_, err = checkCapabilities(p, testConfig("vs-v6", poolName("v6", "app"), "8080", "fd00::1"))
+	if err == nil {
+		t.Error("config without usable targets was accepted")
+	}
+
+	p = newLBProvider("hosts", capsProvider{mem, providers.Capabilities{IPv6: true}})
+	config.LBTargets[1].Port = "8081"
+	if _, err = checkCapabilities(p, config); err == nil {
+		t.Error("target port mismatch was accepted by a provider registering whole hosts")
+	}
+}
+
+func TestHeldEndpoints(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	mem.SetLBConfigs(testConfig("vs-db", poolName("db", "app"), "5432", "10.0.0.3"))
+	db := testService("db", "app", "vs-db", "5432", "10.0.0.3", "10.0.0.4")
+	db.Labels[serviceLabelProvider] = "unknown"
+	fake := &fakeMetadata{services: []rmetadata.Service{db}}
+	setTestGlobals(mem, fake)
+
+	metadataConfigs, err := m.GetMetadataLBConfigs(targetPoolSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateProviderLBConfigs(metadataConfigs); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := mem.Calls(); len(calls) != 0 {
+		t.Errorf("skipped endpoint was changed: %v", calls)
+	}
+	assertProviderState(t, "held", mem, map[string]model.LBConfig{
+		"vs-db": testConfig("vs-db", poolName("db", "app"), "5432", "10.0.0.3"),
+	}, nil)
+
+	list := endpointStatus.List()
+	if len(list) != 1 || list[0].Skipped != "provider 'unknown' is not configured" {
+		t.Errorf("unexpected status: %+v", list)
+	}
+}
+
+func TestCheckWeight(t *testing.T) {
+	mem := memory.NewMemoryProvider()
+	weighted := newLBProvider("weighted", capsProvider{mem, providers.Capabilities{
+		Weights: true, DefaultWeight: 1, MaxWeight: 20,
+	}})
+	unweighted := newLBProvider("unweighted", capsProvider{mem, providers.Capabilities{}})
+
+	tests := []struct {
+		p      *lbProvider
+		weight int
+		want   int
+	}{
+		{weighted, 0, 1},
+		{weighted, 5, 5},
+		{weighted, 50, 20},
+		{unweighted, 5, 0},
+		{newLBProvider("memory", mem), 0, 0},
+	}
+	for _, test := range tests {
+		target := model.LBTarget{HostIP: "10.0.0.1", Port: "8080", Weight: test.weight}
+		if got := checkWeight(test.p, "vs-web", target); got != test.want {
+			t.Errorf("%s: weight %d = %d, want %d", test.p.slug, test.weight, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// Scheduler coalesces reconcile triggers from several sources (metadata
+// changes, periodic resyncs, manual requests) and runs the reconcile
+// function once per burst of triggers.
+type Scheduler struct {
+	// debounce is how long the scheduler waits for the triggers
+	// to settle before running the reconcile function.
+	debounce time.Duration
+	// maxDelay bounds how long a continuous stream of triggers
+	// can postpone the reconcile function.
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	force   bool
+	reasons map[string]bool
+	notify  chan struct{}
+}
+
+// NewScheduler returns a scheduler with the specified debounce window.
+func NewScheduler(debounce, maxDelay time.Duration) *Scheduler {
+	if maxDelay < debounce {
+		maxDelay = debounce
+	}
+	return &Scheduler{
+		debounce: debounce,
+		maxDelay: maxDelay,
+		reasons:  make(map[string]bool),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests a reconcile. If force is true, the reconcile
+// applies the configs even if metadata has not changed.
+// It never blocks.
+func (s *Scheduler) Trigger(reason string, force bool) {
+	s.mu.Lock()
+	s.reasons[reason] = true
+	s.force = s.force || force
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run calls reconcile for every coalesced burst of triggers
+// until stop is closed.
+func (s *Scheduler) Run(reconcile func(force bool), stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.notify:
+		}
+
+		if !s.wait(stop) {
+			return
+		}
+
+		force, reasons := s.take()
+		logrus.Debugf("Reconciling (force: %t) triggered by: %s", force, strings.Join(reasons, ", "))
+		reconcile(force)
+	}
+}
+
+// wait blocks until no trigger was received for the debounce
+// window or maxDelay has passed. It returns false if stopped.
+func (s *Scheduler) wait(stop <-chan struct{}) bool {
+	deadline := time.Now().Add(s.maxDelay)
+	timer := time.NewTimer(s.debounce)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-timer.C:
+			return true
+		case <-s.notify:
+			d := s.debounce
+			if remaining := deadline.Sub(time.Now()); remaining < d {
+				d = remaining
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(d)
+		}
+	}
+}
+
+func (s *Scheduler) take() (bool, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	force := s.force
+	reasons := make([]string, 0, len(s.reasons))
+	for reason := range s.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	s.force = false
+	s.reasons = make(map[string]bool)
+	return force, reasons
+}
+
+// WatchMetadata triggers a reconcile whenever the metadata version
+// changes. It blocks forever.
+func (s *Scheduler) WatchMetadata(client metadata.Client, intervalSeconds int) {
+	client.OnChange(intervalSeconds, func(version string) {
+		logrus.Debugf("Metadata version changed to %s", version)
+		s.Trigger("metadata", false)
+	})
+}
+
+// Resync triggers a forced reconcile every interval, adding a random
+// delay of up to jitter*interval. It blocks until stop is closed.
+func (s *Scheduler) Resync(interval time.Duration, jitter float64, stop <-chan struct{}) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		d := interval + time.Duration(jitter*r.Float64()*float64(interval))
+		select {
+		case <-stop:
+			return
+		case <-time.After(d):
+			s.Trigger("resync", true)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type reconcileRecorder struct {
+	mu    sync.Mutex
+	calls []bool
+	done  chan struct{}
+}
+
+func newReconcileRecorder() *reconcileRecorder {
+	return &reconcileRecorder{done: make(chan struct{}, 10)}
+}
+
+func (r *reconcileRecorder) reconcile(force bool) {
+	r.mu.Lock()
+	r.calls = append(r.calls, force)
+	r.mu.Unlock()
+	r.done <- struct{}{}
+}
+
+func (r *reconcileRecorder) get() []bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]bool(nil), r.calls...)
+}
+
+func TestSchedulerCoalescesTriggers(t *testing.T) {
+	s := NewScheduler(50*time.Millisecond, time.Second)
+	r := newReconcileRecorder()
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Run(r.reconcile, stop)
+
+	// a flapping service
+	for i := 0; i < 20; i++ {
+		s.Trigger("metadata", false)
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.Trigger("resync", true)
+
+	select {
+	case <-r.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconcile was not called")
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	calls := r.get()
+	if len(calls) != 1 {
+		t.Fatalf("reconcile called %d times, want 1", len(calls))
+	}
+	if !calls[0] {
+		t.Error("forced trigger was not preserved when coalescing")
+	}
+}
+
+func TestSchedulerMaxDelay(t *testing.T) {
+	s := NewScheduler(50*time.Millisecond, 100*time.Millisecond)
+	r := newReconcileRecorder()
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Run(r.reconcile, stop)
+
+	start := time.Now()
+	deadline := start.Add(400 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		s.Trigger("metadata", false)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if calls := r.get(); len(calls) < 2 {
+		t.Errorf("continuous triggers delayed reconcile: %d calls in %v", len(calls), time.Since(start))
+	}
+	if calls := r.get(); len(calls) > 0 && calls[0] {
+		t.Error("unforced trigger resulted in a forced reconcile")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rancher/external-lb/model"
+)
+
+// EndpointStatus describes the desired and actual state of an LB endpoint.
+type EndpointStatus struct {
+	Endpoint string `json:"endpoint"`
+	// Provider is the slug of the provider the endpoint is routed to,
+	// or of the provider holding it if it is not in metadata.
+	Provider string `json:"provider"`
+	// Desired is the config from metadata, nil if the endpoint is not in metadata.
+	Desired *model.LBConfig `json:"desired"`
+	// Actual is the config last reported by the provider, nil if the
+	// provider has no config for the endpoint.
+	Actual *model.LBConfig `json:"actual"`
+	// Skipped is the reason the config from metadata is not applied.
+	Skipped       string     `json:"skipped,omitempty"`
+	LastOp        string     `json:"lastOp,omitempty"`
+	LastOpTime    *time.Time `json:"lastOpTime,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+
+	desiredProvider string
+	actualProvider  string
+}
+
+// statusStore keeps the last known status of every endpoint.
+type statusStore struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointStatus
+	// endpoints to re-apply on the next reconcile
+	forced map[string]bool
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{
+		endpoints: make(map[string]*EndpointStatus),
+		forced:    make(map[string]bool),
+	}
+}
+
+func (s *statusStore) get(endpoint string) *EndpointStatus {
+	status, ok := s.endpoints[endpoint]
+	if !ok {
+		status = &EndpointStatus{Endpoint: endpoint}
+		s.endpoints[endpoint] = status
+	}
+	return status
+}
+
+// SetDesired records the configs read from metadata, keyed by the slug
+// of the provider they are routed to, and the reasons for skipping the
+// held endpoints.
+func (s *statusStore) SetDesired(routed map[string]map[string]model.LBConfig, held map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, status := range s.endpoints {
+		status.Desired = nil
+		status.desiredProvider = ""
+		status.Skipped = ""
+	}
+	for endpoint, reason := range held {
+		s.get(endpoint).Skipped = reason
+	}
+	for slug, configs := range routed {
+		for endpoint, config := range configs {
+			c := config
+			status := s.get(endpoint)
+			status.Desired = &c
+			status.desiredProvider = slug
+		}
+	}
+	s.prune()
+}
+
+// SetActual records the configs reported by the specified provider.
+func (s *statusStore) SetActual(slug string, configs map[string]model.LBConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for endpoint, status := range s.endpoints {
+		if _, ok := configs[endpoint]; !ok && status.actualProvider == slug {
+			status.Actual = nil
+			status.actualProvider = ""
+		}
+	}
+	for endpoint, config := range configs {
+		c := config
+		status := s.get(endpoint)
+		status.Actual = &c
+		status.actualProvider = slug
+	}
+	s.prune()
+}
+
+// SetResult records the outcome of an operation on the endpoint.
+func (s *statusStore) SetResult(endpoint string, op Op, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	status := s.get(endpoint)
+	status.LastOp = op.String()
+	status.LastOpTime = &now
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorTime = &now
+	} else {
+		status.LastError = ""
+		status.LastErrorTime = nil
+	}
+}
+
+// prune drops endpoints that are neither in metadata nor on a provider.
+func (s *statusStore) prune() {
+	for endpoint, status := range s.endpoints {
+		if status.Desired == nil && status.Actual == nil && status.Skipped == "" {
+			delete(s.endpoints, endpoint)
+		}
+	}
+}
+
+// List returns a copy of all endpoint statuses sorted by endpoint.
+func (s *statusStore) List() []EndpointStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]EndpointStatus, 0, len(s.endpoints))
+	for _, status := range s.endpoints {
+		entry := *status
+		entry.Provider = status.desiredProvider
+		if entry.Provider == "" {
+			entry.Provider = status.actualProvider
+		}
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Endpoint < list[j].Endpoint
+	})
+	return list
+}
+
+// Known returns true if the endpoint is in metadata or on the provider.
+func (s *statusStore) Known(endpoint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.endpoints[endpoint]
+	return ok
+}
+
+// Force marks the endpoint to be re-applied on the next reconcile.
+func (s *statusStore) Force(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forced[endpoint] = true
+}
+
+// TakeForced returns and clears the endpoints marked by Force.
+func (s *statusStore) TakeForced() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	forced := s.forced
+	s.forced = make(map[string]bool)
+	return forced
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rancher/external-lb/model"
+)
+
+// forEachEndpoint calls fn for every config using up to workers
+// goroutines. Configs of the same endpoint are handled by a single
+// goroutine in their original order, so operations on one endpoint
+// never overlap. With one worker, all configs are handled in order.
+func forEachEndpoint(configs []model.LBConfig, workers int, fn func(model.LBConfig)) {
+	if workers <= 1 || len(configs) <= 1 {
+		for _, config := range configs {
+			fn(config)
+		}
+		return
+	}
+
+	// group the configs by endpoint, keeping the order of first appearance
+	var endpoints []string
+	queues := make(map[string][]model.LBConfig)
+	for _, config := range configs {
+		if _, ok := queues[config.LBEndpoint]; !ok {
+			endpoints = append(endpoints, config.LBEndpoint)
+		}
+		queues[config.LBEndpoint] = append(queues[config.LBEndpoint], config)
+	}
+
+	if workers > len(endpoints) {
+		workers = len(endpoints)
+	}
+
+	work := make(chan []model.LBConfig)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for queue := range work {
+				for _, config := range queue {
+					fn(config)
+				}
+			}
+		}()
+	}
+
+	for _, endpoint := range endpoints {
+		work <- queues[endpoint]
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/external-lb/model"
+)
+
+func TestForEachEndpoint(t *testing.T) {
+	var configs []model.LBConfig
+	for i := 0; i < 20; i++ {
+		for step := 0; step < 3; step++ {
+			configs = append(configs, model.LBConfig{
+				LBEndpoint:   fmt.Sprintf("vs-%d", i),
+				LBTargetPort: fmt.Sprint(step),
+			})
+		}
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	active := make(map[string]bool)
+	seen := make(map[string][]string)
+	forEachEndpoint(configs, 4, func(config model.LBConfig) {
+		mu.Lock()
+		if active[config.LBEndpoint] {
+			t.Errorf("concurrent operations on endpoint %s", config.LBEndpoint)
+		}
+		active[config.LBEndpoint] = true
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		active[config.LBEndpoint] = false
+		seen[config.LBEndpoint] = append(seen[config.LBEndpoint], config.LBTargetPort)
+		mu.Unlock()
+	})
+
+	if maxRunning > 4 {
+		t.Errorf("%d operations ran concurrently, want at most 4", maxRunning)
+	}
+	if maxRunning < 2 {
+		t.Errorf("operations did not run concurrently")
+	}
+	for endpoint, steps := range seen {
+		if !equalStrings(steps, []string{"0", "1", "2"}) {
+			t.Errorf("endpoint %s operations ran in order %v", endpoint, steps)
+		}
+	}
+	if len(seen) != 20 {
+		t.Errorf("handled %d endpoints, want 20", len(seen))
+	}
+}